@@ -0,0 +1,147 @@
+package grumble
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// -- C H I L D R E N -------------------------------------------------------
+
+// ChildCollection describes a field of a parent Kind holding the parent's
+// children, like Items []*Item `grumble:"children"`. The collection holds
+// the entities of the field's Kind, and of the Kinds derived from it, that
+// have the parent as their direct parent. They are ordered by the sort tag,
+// a comma separated list of fields each optionally followed by :ASC or
+// :DESC, and then by id.
+//
+// Collections are not loaded by Get or queries. Use LoadChildren to load
+// them for a single entity and PreloadChildren or Query.Preload to load
+// them for many entities at once. Putting a parent does not store its
+// children.
+type ChildCollection struct {
+	FieldName   string
+	Index       []int
+	Owner       *Kind
+	Kind        *Kind
+	Sort        []Sort
+	VerboseName string
+	Tags        *Tags
+}
+
+func (k *Kind) addChildCollection(field reflect.StructField, child *Kind, tags *Tags) {
+	if _, ok := k.ChildCollection(field.Name); ok {
+		panic(fmt.Sprintf("Kind '%s' cannot have two child collections with the same name '%s'", k.Kind, field.Name))
+	}
+	coll := &ChildCollection{
+		FieldName:   field.Name,
+		Index:       []int{field.Index[0]},
+		Owner:       k,
+		Kind:        child,
+		Sort:        make([]Sort, 0),
+		VerboseName: field.Name,
+		Tags:        tags,
+	}
+	if tags.Has("verbosename") {
+		coll.VerboseName = tags.Get("verbosename")
+	}
+	if tags.Has("sort") {
+		for _, sortorder := range tags.GetStringList("sort") {
+			s := strings.Split(strings.TrimSpace(sortorder), ":")
+			sort := Sort{Column: s[0], Direction: Ascending}
+			if len(s) > 1 {
+				switch dir := SortOrder(strings.ToUpper(s[1])); dir {
+				case Ascending, Descending:
+					sort.Direction = dir
+				default:
+					panic(fmt.Sprintf("Kind '%s': invalid sort order %q for child collection '%s'",
+						k.Kind, s[1], field.Name))
+				}
+			}
+			coll.Sort = append(coll.Sort, sort)
+		}
+	}
+	k.Children = append(k.Children, coll)
+}
+
+// ChildCollection returns the child collection stored in the field with the
+// given name.
+func (k *Kind) ChildCollection(fieldName string) (coll *ChildCollection, ok bool) {
+	for _, c := range k.Children {
+		if c.FieldName == fieldName {
+			return c, true
+		}
+	}
+	return
+}
+
+func (coll *ChildCollection) selected(fields []string) bool {
+	if len(fields) == 0 {
+		return true
+	}
+	for _, field := range fields {
+		if field == coll.FieldName {
+			return true
+		}
+	}
+	return false
+}
+
+// LoadChildren fills the child collections of e with the given field names,
+// or all of them if no names are given.
+func (mgr *EntityManager) LoadChildren(e Persistable, fields ...string) (err error) {
+	return mgr.PreloadChildren([]Persistable{e}, fields...)
+}
+
+// PreloadChildren fills the child collections with the given field names,
+// or all of them, of the entities in parents. Each collection is read with
+// one query for all parents.
+func (mgr *EntityManager) PreloadChildren(parents []Persistable, fields ...string) (err error) {
+	type collectionParent struct {
+		e    Persistable
+		coll *ChildCollection
+	}
+	collections := make(map[string][]collectionParent)
+	for _, e := range parents {
+		if e == nil || e.Kind() == nil || e.Id() <= 0 {
+			continue
+		}
+		for _, coll := range e.Kind().Children {
+			if coll.selected(fields) {
+				name := coll.Owner.Kind + "." + coll.FieldName
+				collections[name] = append(collections[name], collectionParent{e, coll})
+			}
+		}
+	}
+	for _, collParents := range collections {
+		coll := collParents[0].coll
+		keys := make([]*Key, 0, len(collParents))
+		for _, p := range collParents {
+			keys = append(keys, p.e.AsKey())
+		}
+		query := mgr.MakeQuery(coll.Kind)
+		query.WithDerived = true
+		query.AddCondition(&HasParentIn{Parents: keys})
+		for _, sort := range coll.Sort {
+			query.AddSort(sort)
+		}
+		var results [][]Persistable
+		if results, err = query.Execute(); err != nil {
+			return
+		}
+		children := make(map[string][]Persistable)
+		for _, row := range results {
+			parent := row[0].Parent().String()
+			children[parent] = append(children[parent], row[0])
+		}
+		for _, p := range collParents {
+			fld := reflect.ValueOf(p.e).Elem().FieldByIndex(p.coll.Index)
+			slice := reflect.MakeSlice(fld.Type(), 0, len(children[p.e.AsKey().String()]))
+			for _, child := range children[p.e.AsKey().String()] {
+				slice = reflect.Append(slice, reflect.ValueOf(CastTo(child, p.coll.Kind)))
+			}
+			fld.Set(slice)
+		}
+	}
+	return
+}
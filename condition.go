@@ -1,8 +1,12 @@
 package grumble
 
 import (
+	"errors"
 	"fmt"
+	"reflect"
 	"strings"
+
+	"github.com/lib/pq"
 )
 
 // --------------------------------------------------------------------------
@@ -73,6 +77,24 @@ func (cond *HasId) Values(values []interface{}) []interface{} {
 
 // --------------------------------------------------------------------------
 
+type HasIds struct {
+	Ids []int
+}
+
+func (cond *HasIds) WhereClause(query *Query, queryConstraint bool) string {
+	alias := ""
+	if queryConstraint {
+		alias = query.Alias + "."
+	}
+	return fmt.Sprintf("%s\"_id\" = ANY(__count__)", alias)
+}
+
+func (cond *HasIds) Values(values []interface{}) []interface{} {
+	return append(values, pq.Array(cond.Ids))
+}
+
+// --------------------------------------------------------------------------
+
 type HasMaxValue struct {
 	Column string
 }
@@ -110,6 +132,30 @@ func (cond *HasMinValue) Values(values []interface{}) []interface{} {
 
 // --------------------------------------------------------------------------
 
+// IsNull matches rows where Column is NULL, or, if Invert is set, where it is
+// not NULL.
+type IsNull struct {
+	Column string
+	Invert bool
+}
+
+func (cond *IsNull) WhereClause(query *Query, queryConstraint bool) string {
+	alias := ""
+	if queryConstraint {
+		alias = query.Alias + "."
+	}
+	if cond.Invert {
+		return fmt.Sprintf("%s%q IS NOT NULL", alias, cond.Column)
+	}
+	return fmt.Sprintf("%s%q IS NULL", alias, cond.Column)
+}
+
+func (cond *IsNull) Values(values []interface{}) []interface{} {
+	return values
+}
+
+// --------------------------------------------------------------------------
+
 type HasParent struct {
 	Parent *Key
 }
@@ -142,6 +188,31 @@ func (cond *HasParent) Values(values []interface{}) (ret []interface{}) {
 
 // --------------------------------------------------------------------------
 
+// HasParentIn matches entities whose direct parent is one of Parents.
+type HasParentIn struct {
+	Parents []*Key
+}
+
+func (cond *HasParentIn) WhereClause(query *Query, queryConstraint bool) string {
+	alias := ""
+	if queryConstraint {
+		alias = query.Alias + "."
+	}
+	return fmt.Sprintf("%s\"_parent\"[1] = ANY(__count__::%s.\"Reference\"[])", alias, query.Manager.Schema)
+}
+
+func (cond *HasParentIn) Values(values []interface{}) []interface{} {
+	parents := make([]string, 0, len(cond.Parents))
+	for _, parent := range cond.Parents {
+		if parent != nil && !parent.IsZero() {
+			parents = append(parents, parent.String())
+		}
+	}
+	return append(values, pq.Array(parents))
+}
+
+// --------------------------------------------------------------------------
+
 type HasAncestor struct {
 	Ancestor *Key
 }
@@ -152,7 +223,8 @@ func (cond *HasAncestor) WhereClause(query *Query, queryConstraint bool) string
 		alias = query.Alias + "."
 	}
 	if cond.Ancestor != nil && !cond.Ancestor.IsZero() {
-		return fmt.Sprintf("__count__::%s.\"Reference\" = ANY(%s\"_parent\")", query.Manager.Schema, alias)
+		// Containment, unlike = ANY, can use the GIN index on _parent.
+		return fmt.Sprintf("%s\"_parent\" @> ARRAY[__count__::%s.\"Reference\"]", alias, query.Manager.Schema)
 	} else {
 		return "1 = 1"
 	}
@@ -168,6 +240,25 @@ func (cond *HasAncestor) Values(values []interface{}) (ret []interface{}) {
 
 // --------------------------------------------------------------------------
 
+// HasMaxDepth matches entities with at most Depth ancestors.
+type HasMaxDepth struct {
+	Depth int
+}
+
+func (cond *HasMaxDepth) WhereClause(query *Query, queryConstraint bool) string {
+	alias := ""
+	if queryConstraint {
+		alias = query.Alias + "."
+	}
+	return fmt.Sprintf("cardinality(%s\"_parent\") <= __count__", alias)
+}
+
+func (cond *HasMaxDepth) Values(values []interface{}) []interface{} {
+	return append(values, cond.Depth)
+}
+
+// --------------------------------------------------------------------------
+
 type IsRoot struct {
 }
 
@@ -296,6 +387,285 @@ func (cond *References) Values(values []interface{}) (ret []interface{}) {
 
 // --------------------------------------------------------------------------
 
+// ReferencesKind matches rows where the reference column Column points to an
+// entity of one of the Kinds in Kinds, or of a Kind derived from one of
+// them. If Invert is set, it matches rows referencing an entity of any other
+// Kind. Rows not referencing anything never match. Kinds can be anything
+// accepted by GetKind, or a slice of those.
+type ReferencesKind struct {
+	Column string
+	Kinds  interface{}
+	Invert bool
+	kinds  []string
+}
+
+func (cond *ReferencesKind) WhereClause(query *Query, queryConstraint bool) string {
+	cond.kinds = make([]string, 0)
+	addKind := func(kind interface{}) {
+		k := GetKind(kind)
+		if k == nil {
+			panic(fmt.Sprintf("Can't do ReferencesKind condition using %v (%T)", kind, kind))
+		}
+		cond.kinds = append(cond.kinds, k.Kind)
+		for _, derived := range k.DerivedKinds() {
+			cond.kinds = append(cond.kinds, derived.Kind)
+		}
+	}
+	if v := reflect.ValueOf(cond.Kinds); v.Kind() == reflect.Slice {
+		for ix := 0; ix < v.Len(); ix++ {
+			addKind(v.Index(ix).Interface())
+		}
+	} else {
+		addKind(cond.Kinds)
+	}
+	alias := ""
+	if queryConstraint {
+		alias = query.Alias + "."
+	}
+	op := "= ANY"
+	if cond.Invert {
+		op = "<> ALL"
+	}
+	return fmt.Sprintf("((%s%q).\"id\" > 0 AND (%s%q).\"kind\" %s(__count__))", alias, cond.Column, alias, cond.Column, op)
+}
+
+func (cond *ReferencesKind) Values(values []interface{}) []interface{} {
+	return append(values, pq.Array(cond.kinds))
+}
+
+// --------------------------------------------------------------------------
+
+// HasAnyOf matches entities whose many-to-many field Field references at
+// least one of the entities in References, or, if Invert is set, none of
+// them. References can be a *Key, a Persistable, or a slice of either. Kind
+// is the Kind declaring Field and defaults to the Kind of the query.
+type HasAnyOf struct {
+	Kind       *Kind
+	Field      string
+	References interface{}
+	Invert     bool
+	references []string
+}
+
+func (cond *HasAnyOf) WhereClause(query *Query, queryConstraint bool) string {
+	k := cond.Kind
+	if k == nil {
+		k = query.Kind
+	}
+	link, ok := k.Link(cond.Field)
+	if !ok {
+		panic(fmt.Sprintf("Can't do HasAnyOf condition: kind '%s' has no many-to-many field '%s'", k.Kind, cond.Field))
+	}
+	cond.references = referenceKeys(cond.References)
+	if len(cond.references) == 0 {
+		if cond.Invert {
+			return "TRUE"
+		}
+		return "FALSE"
+	}
+	owner := fmt.Sprintf("ROW(%s, \"_id\")", kindExpression(k))
+	if queryConstraint {
+		owner = fmt.Sprintf("ROW(%s.\"_kind\", %s.\"_id\")", query.Alias, query.Alias)
+	}
+	params := strings.Repeat(fmt.Sprintf("__count__::%s.\"Reference\", ", query.Manager.Schema), len(cond.references))
+	op := "IN"
+	if cond.Invert {
+		op = "NOT IN"
+	}
+	return fmt.Sprintf("%s::%s.\"Reference\" %s ( SELECT \"_owner\" FROM %s WHERE \"_target\" IN ( %s ) )",
+		owner, query.Manager.Schema, op, link.QualifiedTableName(), params[0:len(params)-2])
+}
+
+func (cond *HasAnyOf) Values(values []interface{}) (ret []interface{}) {
+	ret = values
+	for _, ref := range cond.references {
+		ret = append(ret, ref)
+	}
+	return
+}
+
+// kindExpression returns an SQL expression for the name of the Kind of a row
+// read from the table of k or, since the WHERE clause of a query is shared
+// between them, the table of a Kind derived from k. Single-table hierarchies
+// store it in the _kind column.
+func kindExpression(k *Kind) string {
+	if k.SingleTable {
+		return "\"_kind\""
+	}
+	derived := k.DerivedKinds()
+	if len(derived) == 0 {
+		return fmt.Sprintf("'%s'", k.Kind)
+	}
+	s := "CASE \"tableoid\""
+	for _, kind := range append([]*Kind{k}, derived...) {
+		s += fmt.Sprintf(" WHEN '%s'::regclass THEN '%s'", kind.QualifiedTableName(), kind.Kind)
+	}
+	return s + " END"
+}
+
+func referenceKeys(refs interface{}) (keys []string) {
+	switch ref := refs.(type) {
+	case nil:
+	case *Key:
+		if ref != nil && !ref.IsZero() {
+			keys = append(keys, ref.String())
+		}
+	case Persistable:
+		if !reflect.ValueOf(ref).IsNil() {
+			keys = append(keys, ref.AsKey().String())
+		}
+	default:
+		v := reflect.ValueOf(refs)
+		if v.Kind() != reflect.Slice {
+			panic(fmt.Sprintf("Can't do HasAnyOf condition using %v (%T)", ref, ref))
+		}
+		for ix := 0; ix < v.Len(); ix++ {
+			keys = append(keys, referenceKeys(v.Index(ix).Interface())...)
+		}
+	}
+	return
+}
+
+// --------------------------------------------------------------------------
+
+// ArrayContains matches rows where the ARRAY column Column contains all
+// elements of the slice Elements.
+type ArrayContains struct {
+	Column   string
+	Elements interface{}
+}
+
+func (cond *ArrayContains) WhereClause(query *Query, queryConstraint bool) string {
+	alias := ""
+	if queryConstraint {
+		alias = query.Alias + "."
+	}
+	return fmt.Sprintf("%s%q @> __count__", alias, cond.Column)
+}
+
+func (cond *ArrayContains) Values(values []interface{}) []interface{} {
+	return append(values, Array{Elements: cond.Elements})
+}
+
+// --------------------------------------------------------------------------
+
+// ArrayOverlaps matches rows where the ARRAY column Column has at least one
+// element in common with the slice Elements.
+type ArrayOverlaps struct {
+	Column   string
+	Elements interface{}
+}
+
+func (cond *ArrayOverlaps) WhereClause(query *Query, queryConstraint bool) string {
+	alias := ""
+	if queryConstraint {
+		alias = query.Alias + "."
+	}
+	return fmt.Sprintf("%s%q && __count__", alias, cond.Column)
+}
+
+func (cond *ArrayOverlaps) Values(values []interface{}) []interface{} {
+	return append(values, Array{Elements: cond.Elements})
+}
+
+// --------------------------------------------------------------------------
+
+// ArrayAnyEquals matches rows where any element of the ARRAY column Column
+// equals Value.
+type ArrayAnyEquals struct {
+	Column string
+	Value  interface{}
+}
+
+func (cond *ArrayAnyEquals) WhereClause(query *Query, queryConstraint bool) string {
+	alias := ""
+	if queryConstraint {
+		alias = query.Alias + "."
+	}
+	return fmt.Sprintf("__count__ = ANY(%s%q)", alias, cond.Column)
+}
+
+func (cond *ArrayAnyEquals) Values(values []interface{}) []interface{} {
+	return append(values, cond.Value)
+}
+
+// MakeArrayCondition returns the condition matching the ARRAY column against
+// the comma-separated list elements. The operator is "contains", "overlaps"
+// or "any". If it is empty, "contains" is used.
+func MakeArrayCondition(operator string, column string, elements string) (cond Condition, err error) {
+	switch strings.ToLower(operator) {
+	case "", "contains":
+		cond = &ArrayContains{Column: column, Elements: strings.Split(elements, ",")}
+	case "overlaps":
+		cond = &ArrayOverlaps{Column: column, Elements: strings.Split(elements, ",")}
+	case "any":
+		cond = &ArrayAnyEquals{Column: column, Value: elements}
+	default:
+		err = errors.New(fmt.Sprintf("unknown ARRAY operator '%s'", operator))
+	}
+	return
+}
+
+// --------------------------------------------------------------------------
+
+func jsonPath(alias string, column string, path []string) string {
+	if len(path) == 0 {
+		return fmt.Sprintf("%s%q", alias, column)
+	}
+	return fmt.Sprintf("(%s%q #> __count__)", alias, column)
+}
+
+func jsonPathValues(values []interface{}, path []string) []interface{} {
+	if len(path) == 0 {
+		return values
+	}
+	return append(values, Array{Elements: path})
+}
+
+// JSONContains matches rows where the jsonb column Column, or the element at
+// Path in it, contains the JSON representation of Value.
+type JSONContains struct {
+	Column string
+	Path   []string
+	Value  interface{}
+}
+
+func (cond *JSONContains) WhereClause(query *Query, queryConstraint bool) string {
+	alias := ""
+	if queryConstraint {
+		alias = query.Alias + "."
+	}
+	return fmt.Sprintf("%s @> __count__::jsonb", jsonPath(alias, cond.Column, cond.Path))
+}
+
+func (cond *JSONContains) Values(values []interface{}) []interface{} {
+	return append(jsonPathValues(values, cond.Path), JSON{Data: cond.Value})
+}
+
+// --------------------------------------------------------------------------
+
+// JSONHasKey matches rows where the jsonb column Column, or the element at
+// Path in it, has the top-level key Key.
+type JSONHasKey struct {
+	Column string
+	Path   []string
+	Key    string
+}
+
+func (cond *JSONHasKey) WhereClause(query *Query, queryConstraint bool) string {
+	alias := ""
+	if queryConstraint {
+		alias = query.Alias + "."
+	}
+	return fmt.Sprintf("%s ? __count__", jsonPath(alias, cond.Column, cond.Path))
+}
+
+func (cond *JSONHasKey) Values(values []interface{}) []interface{} {
+	return append(jsonPathValues(values, cond.Path), cond.Key)
+}
+
+// --------------------------------------------------------------------------
+
 type CompoundCondition struct {
 	Conditions []Condition
 	Operand    string
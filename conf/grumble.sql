@@ -1,4 +1,4 @@
 CREATE TYPE {{.Schema}}."Reference" AS (
     "kind" TEXT,
-    "id" INTEGER
+    "id" BIGINT
 );
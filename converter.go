@@ -1,276 +1,1260 @@
 package grumble
 
 import (
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
 	"math"
+	"net"
 	"reflect"
 	"strconv"
+	"strings"
 	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
 )
 
-type Converter interface {
-	SQLType(Column) string
-	SQLTextOut(Column) string
-	Value(Persistable, Column) ([]interface{}, error)
-	SQLTextIn(Column, string, bool) string
-	Scanners(Column, []interface{}, map[string]interface{}) ([]interface{}, error)
+type Converter interface {
+	SQLType(Column) string
+	SQLTextOut(Column) string
+	Value(Persistable, Column) ([]interface{}, error)
+	SQLTextIn(Column, string, bool) string
+	Scanners(Column, []interface{}, map[string]interface{}) ([]interface{}, error)
+}
+
+type Adapter interface {
+	Converter(field reflect.StructField, tags *Tags) Converter
+}
+
+type Setter interface {
+	SetValue(Persistable, Column, interface{}) error
+}
+
+type BasicConverter struct {
+	sqlType string
+	GoType  reflect.Type
+}
+
+var ConvertersForKind = map[reflect.Kind]Converter{
+	reflect.Bool:    &BasicConverter{"boolean", reflect.TypeOf(true)},
+	reflect.Int:     &BasicConverter{"integer", reflect.TypeOf(1)},
+	reflect.Int8:    &BasicConverter{"smallint", reflect.TypeOf(int8(1))},
+	reflect.Int16:   &BasicConverter{"smallint", reflect.TypeOf(int16(1))},
+	reflect.Int32:   &BasicConverter{"integer", reflect.TypeOf(int32(1))},
+	reflect.Int64:   &BasicConverter{"bigint", reflect.TypeOf(int64(1))},
+	reflect.Uint:    &BasicConverter{"numeric(20,0)", reflect.TypeOf(uint(1))},
+	reflect.Uint8:   &BasicConverter{"integer", reflect.TypeOf(uint8(1))},
+	reflect.Uint16:  &BasicConverter{"integer", reflect.TypeOf(uint16(1))},
+	reflect.Uint32:  &BasicConverter{"bigint", reflect.TypeOf(uint32(1))},
+	reflect.Uint64:  &BasicConverter{"numeric(20,0)", reflect.TypeOf(uint64(1))},
+	reflect.Float32: &BasicConverter{"double precision", reflect.TypeOf(float32(1.0))},
+	reflect.Float64: &BasicConverter{"double precision", reflect.TypeOf(float64(1.0))},
+	reflect.String:  &BasicConverter{"text", reflect.TypeOf("")},
+}
+
+var ConvertersForType = map[reflect.Type]Converter{
+	reflect.TypeOf(time.Time{}):       &BasicConverter{"timestamp without time zone", reflect.TypeOf(time.Time{})},
+	reflect.TypeOf(sql.NullString{}):  &BasicConverter{"text", reflect.TypeOf(sql.NullString{})},
+	reflect.TypeOf(sql.NullInt16{}):   &BasicConverter{"smallint", reflect.TypeOf(sql.NullInt16{})},
+	reflect.TypeOf(sql.NullInt32{}):   &BasicConverter{"integer", reflect.TypeOf(sql.NullInt32{})},
+	reflect.TypeOf(sql.NullInt64{}):   &BasicConverter{"bigint", reflect.TypeOf(sql.NullInt64{})},
+	reflect.TypeOf(sql.NullFloat64{}): &BasicConverter{"double precision", reflect.TypeOf(sql.NullFloat64{})},
+	reflect.TypeOf(sql.NullBool{}):    &BasicConverter{"boolean", reflect.TypeOf(sql.NullBool{})},
+	reflect.TypeOf(sql.NullTime{}):    &BasicConverter{"timestamp without time zone", reflect.TypeOf(sql.NullTime{})},
+	reflect.TypeOf(Decimal{}):         &BasicConverter{"numeric", reflect.TypeOf(Decimal{})},
+	reflect.TypeOf(uuid.UUID{}):       &BasicConverter{"uuid", reflect.TypeOf(uuid.UUID{})},
+	reflect.TypeOf(time.Duration(0)):  &DurationConverter{},
+	reflect.TypeOf(net.IP{}):          &NetConverter{"inet", reflect.TypeOf(net.IP{})},
+	reflect.TypeOf(net.IPNet{}):       &NetConverter{"cidr", reflect.TypeOf(net.IPNet{})},
+}
+
+func GetConverterForType(t reflect.Type) (converter Converter) {
+	switch {
+	case isEnum(t):
+		converter = MakeEnumConverter(t)
+	case t.Kind() == reflect.Ptr:
+		converter = MakePointerConverter(t)
+	case ConvertersForType[t] != nil:
+		converter = ConvertersForType[t]
+	case t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.Uint8:
+		converter = &BasicConverter{sqlType: "bytea", GoType: t}
+	case t.Kind() == reflect.Slice && arrayElementSQLType(t.Elem()) != "":
+		converter = &ArrayConverter{ElementType: arrayElementSQLType(t.Elem()), GoType: t}
+	case t.Kind() == reflect.Map && t.Key().Kind() == reflect.String:
+		converter = &JSONConverter{GoType: t}
+	case t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.Struct:
+		converter = &JSONConverter{GoType: t}
+	case ConvertersForKind[t.Kind()] != nil:
+		converter = ConvertersForKind[t.Kind()]
+	}
+	return
+}
+
+var valuerType = reflect.TypeOf((*driver.Valuer)(nil)).Elem()
+var scannerType = reflect.TypeOf((*sql.Scanner)(nil)).Elem()
+
+// isNullable returns true if columns using converter can hold NULL. This is
+// the case for pointers and for types like sql.NullString that are both a
+// driver.Valuer and an sql.Scanner and have a Valid flag.
+func isNullable(converter Converter) bool {
+	switch c := converter.(type) {
+	case *PointerConverter, *NetConverter:
+		return true
+	case *BasicConverter:
+		if c.GoType == nil || c.GoType.Kind() != reflect.Struct {
+			return false
+		}
+		if valid, ok := c.GoType.FieldByName("Valid"); !ok || valid.Type.Kind() != reflect.Bool {
+			return false
+		}
+		return c.GoType.Implements(valuerType) && reflect.PtrTo(c.GoType).Implements(scannerType)
+	}
+	return false
+}
+
+// -- B A S I C  T Y P E S --------------------------------------------------
+
+type BasicScanner struct {
+	FieldName   string
+	FieldValues map[string]interface{}
+}
+
+func (scanner *BasicScanner) Scan(value interface{}) (err error) {
+	scanner.FieldValues[scanner.FieldName] = value
+	return
+}
+
+// - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - -
+
+func (converter *BasicConverter) SQLType(column Column) string {
+	if converter.sqlType == "numeric" && column.Tags != nil {
+		if precision, ok := column.Tags.GetInt("precision"); ok {
+			scale, _ := column.Tags.GetInt("scale")
+			return fmt.Sprintf("numeric(%d,%d)", precision, scale)
+		}
+	}
+	if converter.sqlType == "timestamp without time zone" && column.Tags != nil {
+		if tz, ok := column.Tags.GetBool("tz"); ok && tz {
+			return "timestamp with time zone"
+		}
+	}
+	return converter.sqlType
+}
+
+func (converter *BasicConverter) SQLTextOut(column Column) string {
+	return "__count__"
+}
+
+func (converter *BasicConverter) Value(e Persistable, column Column) ([]interface{}, error) {
+	value, err := converter.fieldValue(reflect.ValueOf(e).Elem().FieldByIndex(column.Index), column)
+	return []interface{}{value}, err
+}
+
+// fieldValue returns the value of fld. Unsigned integers that don't fit in an
+// int64 are passed as strings, since database/sql rejects them.
+func (converter *BasicConverter) fieldValue(fld reflect.Value, column Column) (interface{}, error) {
+	switch fld.Kind() {
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if fld.Uint() > math.MaxInt64 {
+			return strconv.FormatUint(fld.Uint(), 10), nil
+		}
+		return int64(fld.Uint()), nil
+	}
+	return fld.Interface(), nil
+}
+
+func (converter *BasicConverter) SQLTextIn(column Column, alias string, with bool) string {
+	if alias != "" {
+		alias = alias + "."
+	}
+	return fmt.Sprintf("%s\"%s\"", alias, column.ColumnName)
+}
+
+func (converter *BasicConverter) Scanners(column Column, scanners []interface{}, values map[string]interface{}) ([]interface{}, error) {
+	return append(scanners, &BasicScanner{FieldName: column.FieldName, FieldValues: values}), nil
+}
+
+func (converter *BasicConverter) SetValue(e Persistable, column Column, value interface{}) (err error) {
+	v := reflect.ValueOf(e)
+	if v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		v = v.Elem()
+	}
+	return converter.setField(v.FieldByIndex(column.Index), column, value)
+}
+
+func (converter *BasicConverter) setField(fld reflect.Value, column Column, value interface{}) (err error) {
+	if !fld.IsValid() {
+		return
+	}
+	if s, ok := value.(string); ok && fld.Kind() == reflect.Struct && !fld.Addr().Type().Implements(scannerType) {
+		if fld.Type() != reflect.TypeOf(time.Time{}) {
+			log.Println(column.ColumnName, s)
+			return
+		}
+		var t time.Time
+		if t, err = parseTime(s); err == nil {
+			fld.Set(reflect.ValueOf(t))
+		}
+		return
+	}
+	return assign(fld, value)
+}
+
+// assign sets fld to value, converting value to the type of fld if
+// necessary. Strings are parsed, numbers are converted to the numeric kind
+// of fld, and an error is returned if the value would overflow fld.
+func assign(fld reflect.Value, value interface{}) (err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			err = errors.New(fmt.Sprintf("%v", e))
+		}
+	}()
+	if value != nil && reflect.TypeOf(value) == fld.Type() {
+		fld.Set(reflect.ValueOf(value))
+		return
+	}
+	if fld.CanAddr() && fld.Addr().Type().Implements(scannerType) {
+		return fld.Addr().Interface().(sql.Scanner).Scan(value)
+	}
+	if b, ok := value.([]byte); ok && fld.Kind() != reflect.Slice {
+		value = string(b)
+	}
+	v := reflect.ValueOf(value)
+	switch {
+	case value == nil:
+		fld.Set(reflect.Zero(fld.Type()))
+	case v.Kind() == reflect.String:
+		parseInto(fld, v.String())
+	case v.Kind() >= reflect.Int && v.Kind() <= reflect.Float64:
+		convertInto(fld, v)
+	default:
+		fld.Set(v)
+	}
+	return
+}
+
+func parseInto(fld reflect.Value, s string) {
+	switch fld.Kind() {
+	case reflect.String:
+		fld.SetString(s)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, err := strconv.ParseInt(strings.TrimSpace(s), 10, fld.Type().Bits())
+		if err != nil {
+			panic(fmt.Sprintf("can't convert %q to %s", s, fld.Type()))
+		}
+		fld.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		u, err := strconv.ParseUint(strings.TrimSpace(s), 10, fld.Type().Bits())
+		if err != nil {
+			panic(fmt.Sprintf("can't convert %q to %s", s, fld.Type()))
+		}
+		fld.SetUint(u)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(strings.TrimSpace(s), fld.Type().Bits())
+		if err != nil {
+			panic(fmt.Sprintf("can't convert %q to %s", s, fld.Type()))
+		}
+		fld.SetFloat(f)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(strings.TrimSpace(s))
+		if err != nil {
+			panic(fmt.Sprintf("can't convert %q to bool", s))
+		}
+		fld.SetBool(b)
+	default:
+		panic(fmt.Sprintf("cannot convert strings to objects of kind %q", fld.Kind()))
+	}
+}
+
+func convertInto(fld reflect.Value, v reflect.Value) {
+	isFloat := v.Kind() == reflect.Float32 || v.Kind() == reflect.Float64
+	isUint := v.Kind() >= reflect.Uint && v.Kind() <= reflect.Uintptr
+	overflow := func() {
+		panic(fmt.Sprintf("value %v overflows %s", v.Interface(), fld.Type()))
+	}
+	switch fld.Kind() {
+	case reflect.String:
+		switch {
+		case isFloat:
+			fld.SetString(strconv.FormatFloat(v.Float(), 'g', -1, v.Type().Bits()))
+		case isUint:
+			fld.SetString(strconv.FormatUint(v.Uint(), 10))
+		default:
+			fld.SetString(strconv.FormatInt(v.Int(), 10))
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		var i int64
+		switch {
+		case isFloat:
+			f := math.Round(v.Float())
+			if f < math.MinInt64 || f >= math.MaxInt64 {
+				overflow()
+			}
+			i = int64(f)
+		case isUint:
+			if v.Uint() > math.MaxInt64 {
+				overflow()
+			}
+			i = int64(v.Uint())
+		default:
+			i = v.Int()
+		}
+		if fld.OverflowInt(i) {
+			overflow()
+		}
+		fld.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		var u uint64
+		switch {
+		case isFloat:
+			f := math.Round(v.Float())
+			if f < 0 || f >= math.MaxUint64 {
+				overflow()
+			}
+			u = uint64(f)
+		case isUint:
+			u = v.Uint()
+		default:
+			if v.Int() < 0 {
+				overflow()
+			}
+			u = uint64(v.Int())
+		}
+		if fld.OverflowUint(u) {
+			overflow()
+		}
+		fld.SetUint(u)
+	case reflect.Float32, reflect.Float64:
+		switch {
+		case isFloat:
+			fld.SetFloat(v.Float())
+		case isUint:
+			fld.SetFloat(float64(v.Uint()))
+		default:
+			fld.SetFloat(float64(v.Int()))
+		}
+	case reflect.Bool:
+		fld.SetBool(!v.IsZero())
+	default:
+		panic(fmt.Sprintf("cannot convert numbers to objects of kind %q", fld.Kind()))
+	}
+}
+
+// -- A R R A Y S -----------------------------------------------------------
+
+// arrayTimeLayout is the layout of timestamps in ARRAY literals.
+const arrayTimeLayout = "2006-01-02 15:04:05.999999"
+
+var timeType = reflect.TypeOf(time.Time{})
+
+func arrayElementSQLType(t reflect.Type) string {
+	switch {
+	case t == timeType:
+	case t.Kind() == reflect.String || t.Kind() == reflect.Bool:
+	case t.Kind() >= reflect.Int && t.Kind() <= reflect.Int64:
+	case t.Kind() == reflect.Float32 || t.Kind() == reflect.Float64:
+	default:
+		return ""
+	}
+	if converter, ok := GetConverterForType(t).(*BasicConverter); ok {
+		return converter.sqlType
+	}
+	return ""
+}
+
+type arrayElements interface {
+	driver.Valuer
+	sql.Scanner
+}
+
+func makeArrayElements(t reflect.Type) (elements arrayElements, err error) {
+	switch {
+	case t == timeType || t.Kind() == reflect.String:
+		elements = &pq.StringArray{}
+	case t.Kind() == reflect.Bool:
+		elements = &pq.BoolArray{}
+	case t.Kind() >= reflect.Int && t.Kind() <= reflect.Int64:
+		elements = &pq.Int64Array{}
+	case t.Kind() == reflect.Float32 || t.Kind() == reflect.Float64:
+		elements = &pq.Float64Array{}
+	default:
+		err = errors.New(fmt.Sprintf("cannot use elements of type '%s' in an ARRAY column", t))
+	}
+	return
+}
+
+func toArrayElements(slice reflect.Value) (elements arrayElements, err error) {
+	if elements, err = makeArrayElements(slice.Type().Elem()); err != nil {
+		return
+	}
+	n := slice.Len()
+	switch a := elements.(type) {
+	case *pq.StringArray:
+		*a = make(pq.StringArray, n)
+		for i := 0; i < n; i++ {
+			if t, ok := slice.Index(i).Interface().(time.Time); ok {
+				(*a)[i] = t.Format(arrayTimeLayout)
+			} else {
+				(*a)[i] = slice.Index(i).String()
+			}
+		}
+	case *pq.BoolArray:
+		*a = make(pq.BoolArray, n)
+		for i := 0; i < n; i++ {
+			(*a)[i] = slice.Index(i).Bool()
+		}
+	case *pq.Int64Array:
+		*a = make(pq.Int64Array, n)
+		for i := 0; i < n; i++ {
+			(*a)[i] = slice.Index(i).Int()
+		}
+	case *pq.Float64Array:
+		*a = make(pq.Float64Array, n)
+		for i := 0; i < n; i++ {
+			(*a)[i] = slice.Index(i).Float()
+		}
+	}
+	return
+}
+
+func fromArrayElements(elements arrayElements, t reflect.Type) (slice reflect.Value, err error) {
+	switch a := elements.(type) {
+	case *pq.StringArray:
+		slice = reflect.MakeSlice(t, len(*a), len(*a))
+		for i, s := range *a {
+			if t.Elem() == timeType {
+				var ts time.Time
+				if ts, err = time.Parse(arrayTimeLayout, s); err != nil {
+					return
+				}
+				slice.Index(i).Set(reflect.ValueOf(ts))
+			} else {
+				slice.Index(i).SetString(s)
+			}
+		}
+	case *pq.BoolArray:
+		slice = reflect.MakeSlice(t, len(*a), len(*a))
+		for i, b := range *a {
+			slice.Index(i).SetBool(b)
+		}
+	case *pq.Int64Array:
+		slice = reflect.MakeSlice(t, len(*a), len(*a))
+		for i, n := range *a {
+			slice.Index(i).SetInt(n)
+		}
+	case *pq.Float64Array:
+		slice = reflect.MakeSlice(t, len(*a), len(*a))
+		for i, f := range *a {
+			slice.Index(i).SetFloat(f)
+		}
+	}
+	return
+}
+
+// arrayElement converts value to an element of type t. Strings are parsed,
+// which allows elements to come from forms and query strings.
+func arrayElement(value interface{}, t reflect.Type) (ret reflect.Value, err error) {
+	ret = reflect.New(t).Elem()
+	v := reflect.ValueOf(value)
+	switch {
+	case value == nil:
+		err = errors.New("ARRAY elements can not be NULL")
+	case v.Type() == t:
+		ret.Set(v)
+	case t == timeType && v.Kind() == reflect.String:
+		var ts time.Time
+		if ts, err = time.Parse(time.RFC3339, v.String()); err != nil {
+			if ts, err = time.Parse("2006-01-02", v.String()); err != nil {
+				err = errors.New(fmt.Sprintf("can't convert %q to Time", v.String()))
+				return
+			}
+		}
+		ret.Set(reflect.ValueOf(ts))
+	case v.Kind() == reflect.String:
+		s := strings.TrimSpace(v.String())
+		switch {
+		case t.Kind() == reflect.String:
+			ret.SetString(v.String())
+		case t.Kind() == reflect.Bool:
+			var b bool
+			if b, err = strconv.ParseBool(s); err != nil {
+				return
+			}
+			ret.SetBool(b)
+		case t.Kind() >= reflect.Int && t.Kind() <= reflect.Int64:
+			var i int64
+			if i, err = strconv.ParseInt(s, 10, 64); err != nil {
+				return
+			}
+			ret.SetInt(i)
+		case t.Kind() == reflect.Float32 || t.Kind() == reflect.Float64:
+			var f float64
+			if f, err = strconv.ParseFloat(s, 64); err != nil {
+				return
+			}
+			ret.SetFloat(f)
+		default:
+			err = errors.New(fmt.Sprintf("can't convert %q to %s", v.String(), t))
+		}
+	case v.Kind() >= reflect.Int && v.Kind() <= reflect.Float64 &&
+		t.Kind() >= reflect.Int && t.Kind() <= reflect.Float64:
+		if v.Kind() >= reflect.Float32 && t.Kind() <= reflect.Uint64 {
+			v = reflect.ValueOf(math.Round(v.Float()))
+		}
+		ret.Set(v.Convert(t))
+	case v.Type().ConvertibleTo(t) && v.Kind() == t.Kind():
+		ret.Set(v.Convert(t))
+	default:
+		err = errors.New(fmt.Sprintf("can't convert '%v' (%T) to %s", value, value, t))
+	}
+	return
+}
+
+// Array wraps a slice so it can be used as the parameter value of a query
+// on an ARRAY column. Arrays marshal to JSON as the wrapped slice.
+type Array struct {
+	Elements interface{}
+}
+
+func (a Array) Value() (driver.Value, error) {
+	v := reflect.ValueOf(a.Elements)
+	if v.Kind() != reflect.Slice {
+		return nil, errors.New(fmt.Sprintf("ARRAY value '%v' (%T) is not a slice", a.Elements, a.Elements))
+	}
+	if arrayElementSQLType(v.Type().Elem()) == "" {
+		return pq.Array(a.Elements).Value()
+	}
+	elements, err := toArrayElements(v)
+	if err != nil {
+		return nil, err
+	}
+	return elements.Value()
+}
+
+func (a Array) MarshalJSON() ([]byte, error) {
+	return json.Marshal(a.Elements)
+}
+
+type ArrayScanner struct {
+	FieldName   string
+	FieldValues map[string]interface{}
+	GoType      reflect.Type
+}
+
+func (scanner *ArrayScanner) Scan(value interface{}) (err error) {
+	if value == nil {
+		scanner.FieldValues[scanner.FieldName] = nil
+		return
+	}
+	elements, err := makeArrayElements(scanner.GoType.Elem())
+	if err != nil {
+		return
+	}
+	if err = elements.Scan(value); err != nil {
+		return
+	}
+	slice, err := fromArrayElements(elements, scanner.GoType)
+	if err != nil {
+		return
+	}
+	scanner.FieldValues[scanner.FieldName] = slice.Interface()
+	return
+}
+
+// - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - -
+
+// ArrayConverter maps slices of strings, booleans, numbers and times to
+// native PostgreSQL ARRAY columns.
+type ArrayConverter struct {
+	ElementType string
+	GoType      reflect.Type
+}
+
+func (converter *ArrayConverter) SQLType(column Column) string {
+	return converter.ElementType + "[]"
+}
+
+func (converter *ArrayConverter) SQLTextOut(column Column) string {
+	return "__count__"
+}
+
+func (converter *ArrayConverter) Value(e Persistable, column Column) ([]interface{}, error) {
+	v := reflect.ValueOf(e).Elem()
+	return []interface{}{Array{Elements: v.FieldByIndex(column.Index).Interface()}}, nil
+}
+
+func (converter *ArrayConverter) SQLTextIn(column Column, alias string, with bool) string {
+	if alias != "" {
+		alias = alias + "."
+	}
+	return fmt.Sprintf("%s%q", alias, column.ColumnName)
+}
+
+func (converter *ArrayConverter) Scanners(column Column, scanners []interface{}, values map[string]interface{}) ([]interface{}, error) {
+	return append(scanners, &ArrayScanner{FieldName: column.FieldName, FieldValues: values, GoType: converter.GoType}), nil
+}
+
+// SetValue sets the ARRAY field to value, which can be a slice of any type
+// with elements convertible to the field's element type, or a string holding
+// a comma-separated list of elements.
+func (converter *ArrayConverter) SetValue(e Persistable, column Column, value interface{}) (err error) {
+	fld := reflect.ValueOf(e).Elem().FieldByIndex(column.Index)
+	if !fld.IsValid() {
+		return
+	}
+	if s, ok := value.(string); ok {
+		elements := make([]string, 0)
+		if s != "" {
+			elements = strings.Split(s, ",")
+		}
+		value = elements
+	}
+	v := reflect.ValueOf(value)
+	switch {
+	case value == nil:
+		fld.Set(reflect.Zero(converter.GoType))
+	case v.Type() == converter.GoType:
+		fld.Set(v)
+	case v.Kind() == reflect.Slice || v.Kind() == reflect.Array:
+		slice := reflect.MakeSlice(converter.GoType, v.Len(), v.Len())
+		for i := 0; i < v.Len(); i++ {
+			var elem reflect.Value
+			if elem, err = arrayElement(v.Index(i).Interface(), converter.GoType.Elem()); err != nil {
+				return
+			}
+			slice.Index(i).Set(elem)
+		}
+		fld.Set(slice)
+	default:
+		err = errors.New(fmt.Sprintf("cannot assign '%v' (%T) to ARRAY column %s.%s",
+			value, value, column.Kind.Kind, column.FieldName))
+	}
+	return
+}
+
+// -- J S O N ---------------------------------------------------------------
+
+// JSON wraps a value so it can be used as the parameter value of a query on
+// a jsonb column. JSON values marshal to JSON as the wrapped value.
+type JSON struct {
+	Data interface{}
+}
+
+func (j JSON) Value() (driver.Value, error) {
+	b, err := json.Marshal(j.Data)
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+func (j JSON) MarshalJSON() ([]byte, error) {
+	return json.Marshal(j.Data)
+}
+
+type JSONScanner struct {
+	FieldName   string
+	FieldValues map[string]interface{}
+	GoType      reflect.Type
+}
+
+func (scanner *JSONScanner) Scan(value interface{}) (err error) {
+	var text []byte
+	switch v := value.(type) {
+	case []byte:
+		text = v
+	case string:
+		text = []byte(v)
+	case nil:
+		scanner.FieldValues[scanner.FieldName] = nil
+		return
+	default:
+		err = errors.New(fmt.Sprintf("expected JSON text, got '%v' (%T)", value, value))
+		return
+	}
+	v := reflect.New(scanner.GoType)
+	if err = json.Unmarshal(text, v.Interface()); err != nil {
+		return
+	}
+	scanner.FieldValues[scanner.FieldName] = v.Elem().Interface()
+	return
+}
+
+// - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - -
+
+// JSONConverter stores maps, slices of structs and fields tagged with 'json'
+// as jsonb.
+type JSONConverter struct {
+	GoType reflect.Type
+}
+
+func (converter *JSONConverter) SQLType(column Column) string {
+	return "jsonb"
+}
+
+func (converter *JSONConverter) SQLTextOut(column Column) string {
+	return "__count__"
+}
+
+func (converter *JSONConverter) Value(e Persistable, column Column) ([]interface{}, error) {
+	v := reflect.ValueOf(e).Elem()
+	return []interface{}{JSON{Data: v.FieldByIndex(column.Index).Interface()}}, nil
+}
+
+func (converter *JSONConverter) SQLTextIn(column Column, alias string, with bool) string {
+	if alias != "" {
+		alias = alias + "."
+	}
+	return fmt.Sprintf("%s%q", alias, column.ColumnName)
+}
+
+func (converter *JSONConverter) Scanners(column Column, scanners []interface{}, values map[string]interface{}) ([]interface{}, error) {
+	return append(scanners, &JSONScanner{FieldName: column.FieldName, FieldValues: values, GoType: converter.GoType}), nil
+}
+
+// SetValue sets the jsonb field to value. Strings are parsed as JSON text.
+// Other values are converted to the field's type by way of their JSON
+// representation.
+func (converter *JSONConverter) SetValue(e Persistable, column Column, value interface{}) (err error) {
+	fld := reflect.ValueOf(e).Elem().FieldByIndex(column.Index)
+	if !fld.IsValid() {
+		return
+	}
+	if value == nil {
+		fld.Set(reflect.Zero(converter.GoType))
+		return
+	}
+	if reflect.TypeOf(value) == converter.GoType {
+		fld.Set(reflect.ValueOf(value))
+		return
+	}
+	var text []byte
+	switch v := value.(type) {
+	case string:
+		text = []byte(v)
+	case []byte:
+		text = v
+	default:
+		if text, err = json.Marshal(value); err != nil {
+			return
+		}
+	}
+	v := reflect.New(converter.GoType)
+	if err = json.Unmarshal(text, v.Interface()); err != nil {
+		err = errors.New(fmt.Sprintf("cannot assign '%v' (%T) to jsonb column %s.%s: %s",
+			value, value, column.Kind.Kind, column.FieldName, err))
+		return
+	}
+	fld.Set(v.Elem())
+	return
+}
+
+// -- E N U M S -------------------------------------------------------------
+
+// Enum is implemented by named string and integer types that can only take
+// the values returned by EnumValues. The values of an integer Enum are the
+// indexes into that list. Fields of Enum types are stored as PostgreSQL ENUM
+// types.
+type Enum interface {
+	EnumValues() []string
+}
+
+var enumType = reflect.TypeOf((*Enum)(nil)).Elem()
+
+func isEnum(t reflect.Type) bool {
+	return t.Implements(enumType) &&
+		(t.Kind() == reflect.String || (t.Kind() >= reflect.Int && t.Kind() <= reflect.Uint64))
+}
+
+// EnumConverter maps Enum types to a PostgreSQL ENUM type with the same name
+// as the Go type.
+type EnumConverter struct {
+	TypeName string
+	Values   []string
+	GoType   reflect.Type
+}
+
+func MakeEnumConverter(t reflect.Type) *EnumConverter {
+	return &EnumConverter{
+		TypeName: t.Name(),
+		Values:   reflect.Zero(t).Interface().(Enum).EnumValues(),
+		GoType:   t,
+	}
+}
+
+// Label returns the ENUM label for the given value of the converter's Enum
+// type.
+func (converter *EnumConverter) Label(value interface{}) (label string, err error) {
+	v := reflect.ValueOf(value)
+	switch {
+	case !v.IsValid() || v.Type() != converter.GoType:
+		err = errors.New(fmt.Sprintf("'%v' (%T) is not a %s", value, value, converter.GoType))
+	case v.Kind() == reflect.String:
+		label = v.String()
+		for _, l := range converter.Values {
+			if l == label {
+				return
+			}
+		}
+		err = errors.New(fmt.Sprintf("invalid %s value %q", converter.GoType, label))
+	case v.Kind() >= reflect.Int && v.Kind() <= reflect.Int64:
+		if ix := v.Int(); ix >= 0 && ix < int64(len(converter.Values)) {
+			label = converter.Values[ix]
+		} else {
+			err = errors.New(fmt.Sprintf("invalid %s value %d", converter.GoType, ix))
+		}
+	default:
+		if ix := v.Uint(); ix < uint64(len(converter.Values)) {
+			label = converter.Values[ix]
+		} else {
+			err = errors.New(fmt.Sprintf("invalid %s value %d", converter.GoType, ix))
+		}
+	}
+	return
+}
+
+func (converter *EnumConverter) parse(label string) (ret reflect.Value, err error) {
+	for ix, l := range converter.Values {
+		if l == label {
+			if converter.GoType.Kind() == reflect.String {
+				ret = reflect.ValueOf(label).Convert(converter.GoType)
+			} else {
+				ret = reflect.ValueOf(ix).Convert(converter.GoType)
+			}
+			return
+		}
+	}
+	err = errors.New(fmt.Sprintf("invalid %s value %q", converter.GoType, label))
+	return
+}
+
+func (converter *EnumConverter) SQLType(column Column) string {
+	pg := GetPostgreSQLAdapter()
+	return fmt.Sprintf("%q.%q", pg.GetSchema(), converter.TypeName)
+}
+
+func (converter *EnumConverter) SQLTextOut(column Column) string {
+	return "__count__"
+}
+
+func (converter *EnumConverter) Value(e Persistable, column Column) (values []interface{}, err error) {
+	v := reflect.ValueOf(e).Elem()
+	label, err := converter.fieldValue(v.FieldByIndex(column.Index), column)
+	if err != nil {
+		return
+	}
+	values = []interface{}{label}
+	return
+}
+
+func (converter *EnumConverter) fieldValue(fld reflect.Value, column Column) (label interface{}, err error) {
+	label, err = converter.Label(fld.Interface())
+	if err != nil {
+		err = errors.New(fmt.Sprintf("column '%s.%s': %s", column.Kind.Kind, column.FieldName, err))
+	}
+	return
+}
+
+func (converter *EnumConverter) SQLTextIn(column Column, alias string, with bool) string {
+	if alias != "" {
+		alias = alias + "."
+	}
+	return fmt.Sprintf("%s%q", alias, column.ColumnName)
+}
+
+func (converter *EnumConverter) Scanners(column Column, scanners []interface{}, values map[string]interface{}) ([]interface{}, error) {
+	return append(scanners, &BasicScanner{FieldName: column.FieldName, FieldValues: values}), nil
+}
+
+// SetValue sets the Enum field to value, which can be a value of the Enum
+// type, a label, or for integer Enums a number.
+func (converter *EnumConverter) SetValue(e Persistable, column Column, value interface{}) (err error) {
+	return converter.setField(reflect.ValueOf(e).Elem().FieldByIndex(column.Index), column, value)
+}
+
+func (converter *EnumConverter) setField(fld reflect.Value, column Column, value interface{}) (err error) {
+	if !fld.IsValid() {
+		return
+	}
+	var v reflect.Value
+	switch val := value.(type) {
+	case []byte:
+		v, err = converter.parse(string(val))
+	case string:
+		v, err = converter.parse(val)
+	default:
+		v = reflect.ValueOf(value)
+		switch {
+		case !v.IsValid():
+			err = errors.New(fmt.Sprintf("cannot assign nil to %s column %s.%s",
+				converter.GoType, column.Kind.Kind, column.FieldName))
+		case v.Type() == converter.GoType:
+		case converter.GoType.Kind() != reflect.String && v.Kind() >= reflect.Int && v.Kind() <= reflect.Float64:
+			if v.Kind() >= reflect.Float32 {
+				v = reflect.ValueOf(math.Round(v.Float()))
+			}
+			v = v.Convert(converter.GoType)
+		default:
+			err = errors.New(fmt.Sprintf("cannot assign '%v' (%T) to %s column %s.%s",
+				value, value, converter.GoType, column.Kind.Kind, column.FieldName))
+		}
+		if err == nil {
+			_, err = converter.Label(v.Interface())
+		}
+	}
+	if err != nil {
+		return
+	}
+	fld.Set(v)
+	return
+}
+
+// -- T I M E S -------------------------------------------------------------
+
+var timeLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05",
+	"2006-01-02T15:04",
+	"2006-01-02 15:04:05Z07:00",
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02",
 }
 
-type Adapter interface {
-	Converter(field reflect.StructField, tags *Tags) Converter
+// parseTime parses form input for time.Time fields. It accepts RFC 3339
+// timestamps, the values of HTML date and datetime-local inputs, and the
+// text format PostgreSQL uses for timestamps.
+func parseTime(s string) (t time.Time, err error) {
+	s = strings.TrimSpace(s)
+	for _, layout := range timeLayouts {
+		if t, err = time.Parse(layout, s); err == nil {
+			return
+		}
+	}
+	err = errors.New(fmt.Sprintf("can't convert %q to Time", s))
+	return
 }
 
-type Setter interface {
-	SetValue(Persistable, Column, interface{}) error
+// -- D U R A T I O N S -----------------------------------------------------
+
+// DurationConverter maps time.Duration fields to interval columns.
+type DurationConverter struct {
 }
 
-type BasicConverter struct {
+var intervalUnits = map[string]time.Duration{
+	"year":  time.Duration(365.25 * 24 * float64(time.Hour)),
+	"years": time.Duration(365.25 * 24 * float64(time.Hour)),
+	"mon":   30 * 24 * time.Hour,
+	"mons":  30 * 24 * time.Hour,
+	"day":   24 * time.Hour,
+	"days":  24 * time.Hour,
+}
+
+// parseInterval parses a duration in the format of time.ParseDuration, or in
+// the format PostgreSQL uses for interval values, e.g. "1 day -02:30:00.5".
+// A plain number is a number of seconds, like it is in PostgreSQL.
+func parseInterval(s string) (d time.Duration, err error) {
+	s = strings.TrimSpace(s)
+	if d, err = time.ParseDuration(s); err == nil {
+		return
+	}
+	d = 0
+	err = errors.New(fmt.Sprintf("can't convert %q to Duration", s))
+	fields := strings.Fields(s)
+	if len(fields) == 0 {
+		return
+	}
+	for i := 0; i < len(fields); i++ {
+		f := fields[i]
+		switch {
+		case strings.Contains(f, ":"):
+			sign := time.Duration(1)
+			if strings.HasPrefix(f, "-") {
+				sign, f = -1, f[1:]
+			}
+			parts := strings.Split(f, ":")
+			if len(parts) != 3 {
+				return
+			}
+			hms, e := time.ParseDuration(parts[0] + "h" + parts[1] + "m" + parts[2] + "s")
+			if e != nil {
+				return
+			}
+			d += sign * hms
+		case i+1 < len(fields) && intervalUnits[fields[i+1]] != 0:
+			n, e := strconv.ParseInt(f, 10, 64)
+			if e != nil {
+				return
+			}
+			d += time.Duration(n) * intervalUnits[fields[i+1]]
+			i++
+		case len(fields) == 1:
+			secs, e := strconv.ParseFloat(f, 64)
+			if e != nil {
+				return
+			}
+			d = time.Duration(math.Round(secs * float64(time.Second)))
+		default:
+			return
+		}
+	}
+	err = nil
+	return
+}
+
+func (converter *DurationConverter) SQLType(column Column) string {
+	return "interval"
+}
+
+func (converter *DurationConverter) SQLTextOut(column Column) string {
+	return "__count__"
+}
+
+func (converter *DurationConverter) Value(e Persistable, column Column) ([]interface{}, error) {
+	value, err := converter.fieldValue(reflect.ValueOf(e).Elem().FieldByIndex(column.Index), column)
+	return []interface{}{value}, err
+}
+
+func (converter *DurationConverter) fieldValue(fld reflect.Value, column Column) (interface{}, error) {
+	return fmt.Sprintf("%d microseconds", time.Duration(fld.Int())/time.Microsecond), nil
+}
+
+func (converter *DurationConverter) SQLTextIn(column Column, alias string, with bool) string {
+	if alias != "" {
+		alias = alias + "."
+	}
+	return fmt.Sprintf("%s%q", alias, column.ColumnName)
+}
+
+func (converter *DurationConverter) Scanners(column Column, scanners []interface{}, values map[string]interface{}) ([]interface{}, error) {
+	return append(scanners, &BasicScanner{FieldName: column.FieldName, FieldValues: values}), nil
+}
+
+func (converter *DurationConverter) SetValue(e Persistable, column Column, value interface{}) (err error) {
+	return converter.setField(reflect.ValueOf(e).Elem().FieldByIndex(column.Index), column, value)
+}
+
+func (converter *DurationConverter) setField(fld reflect.Value, column Column, value interface{}) (err error) {
+	if !fld.IsValid() {
+		return
+	}
+	var d time.Duration
+	switch v := value.(type) {
+	case nil:
+	case time.Duration:
+		d = v
+	case []byte:
+		d, err = parseInterval(string(v))
+	case string:
+		d, err = parseInterval(v)
+	case int:
+		d = time.Duration(v) * time.Second
+	case int64:
+		d = time.Duration(v) * time.Second
+	case float64:
+		d = time.Duration(math.Round(v * float64(time.Second)))
+	default:
+		err = errors.New(fmt.Sprintf("cannot assign '%v' (%T) to Duration column %s.%s",
+			value, value, column.Kind.Kind, column.FieldName))
+	}
+	if err != nil {
+		return
+	}
+	fld.SetInt(int64(d))
+	return
+}
+
+// -- N E T W O R K  A D D R E S S E S -------------------------------------
+
+// NetConverter maps net.IP fields to inet columns and net.IPNet fields to
+// cidr columns. An empty address is stored as NULL.
+type NetConverter struct {
 	sqlType string
 	GoType  reflect.Type
 }
 
-var ConvertersForKind = map[reflect.Kind]Converter{
-	reflect.Bool:    &BasicConverter{"boolean", reflect.TypeOf(true)},
-	reflect.Int:     &BasicConverter{"integer", reflect.TypeOf(1)},
-	reflect.Int8:    &BasicConverter{"smallint", reflect.TypeOf(int8(1))},
-	reflect.Int16:   &BasicConverter{"smallint", reflect.TypeOf(int16(1))},
-	reflect.Int32:   &BasicConverter{"integer", reflect.TypeOf(int32(1))},
-	reflect.Int64:   &BasicConverter{"bigint", reflect.TypeOf(int64(1))},
-	reflect.Uint:    &BasicConverter{"integer", reflect.TypeOf(uint(1))},
-	reflect.Uint8:   &BasicConverter{"integer", reflect.TypeOf(uint8(1))},
-	reflect.Uint16:  &BasicConverter{"integer", reflect.TypeOf(uint16(1))},
-	reflect.Uint32:  &BasicConverter{"integer", reflect.TypeOf(uint32(1))},
-	reflect.Uint64:  &BasicConverter{"integer", reflect.TypeOf(uint64(1))},
-	reflect.Float32: &BasicConverter{"double precision", reflect.TypeOf(float32(1.0))},
-	reflect.Float64: &BasicConverter{"double precision", reflect.TypeOf(float64(1.0))},
-	reflect.String:  &BasicConverter{"text", reflect.TypeOf("")},
+func (converter *NetConverter) parse(s string) (ret interface{}, err error) {
+	s = strings.TrimSpace(s)
+	if converter.GoType == reflect.TypeOf(net.IPNet{}) {
+		if !strings.Contains(s, "/") {
+			if ip := net.ParseIP(s); ip != nil && ip.To4() != nil {
+				s += "/32"
+			} else {
+				s += "/128"
+			}
+		}
+		var network *net.IPNet
+		if _, network, err = net.ParseCIDR(s); err != nil {
+			err = errors.New(fmt.Sprintf("can't convert %q to IPNet", s))
+			return
+		}
+		ret = *network
+		return
+	}
+	var ip net.IP
+	if strings.Contains(s, "/") {
+		ip, _, err = net.ParseCIDR(s)
+	} else if ip = net.ParseIP(s); ip == nil {
+		err = errors.New("invalid IP")
+	}
+	if err != nil {
+		err = errors.New(fmt.Sprintf("can't convert %q to IP", s))
+		return
+	}
+	ret = ip
+	return
 }
 
-var ConvertersForType = map[reflect.Type]Converter{
-	reflect.TypeOf(time.Time{}): &BasicConverter{"timestamp without time zone", reflect.TypeOf(time.Time{})},
+func (converter *NetConverter) SQLType(column Column) string {
+	return converter.sqlType
 }
 
-func GetConverterForType(t reflect.Type) (converter Converter) {
-	switch {
-	case t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.Uint8:
-		converter = &BasicConverter{sqlType: "bytea"}
-	case ConvertersForType[t] != nil:
-		converter = ConvertersForType[t]
-	case ConvertersForKind[t.Kind()] != nil:
-		converter = ConvertersForKind[t.Kind()]
+func (converter *NetConverter) SQLTextOut(column Column) string {
+	return "__count__"
+}
+
+func (converter *NetConverter) Value(e Persistable, column Column) ([]interface{}, error) {
+	value, err := converter.fieldValue(reflect.ValueOf(e).Elem().FieldByIndex(column.Index), column)
+	return []interface{}{value}, err
+}
+
+func (converter *NetConverter) fieldValue(fld reflect.Value, column Column) (interface{}, error) {
+	switch v := fld.Interface().(type) {
+	case net.IP:
+		if len(v) > 0 {
+			return v.String(), nil
+		}
+	case net.IPNet:
+		if len(v.IP) > 0 {
+			return v.String(), nil
+		}
 	}
-	return
+	return nil, nil
 }
 
-// -- B A S I C  T Y P E S --------------------------------------------------
+func (converter *NetConverter) SQLTextIn(column Column, alias string, with bool) string {
+	if alias != "" {
+		alias = alias + "."
+	}
+	return fmt.Sprintf("%s%q", alias, column.ColumnName)
+}
 
-type BasicScanner struct {
-	FieldName   string
-	FieldValues map[string]interface{}
+func (converter *NetConverter) Scanners(column Column, scanners []interface{}, values map[string]interface{}) ([]interface{}, error) {
+	return append(scanners, &BasicScanner{FieldName: column.FieldName, FieldValues: values}), nil
 }
 
-func (scanner *BasicScanner) Scan(value interface{}) (err error) {
-	if v, ok := value.(int64); ok { // HACK should deal with 64 bitidy better
-		value = int(v)
+func (converter *NetConverter) SetValue(e Persistable, column Column, value interface{}) (err error) {
+	return converter.setField(reflect.ValueOf(e).Elem().FieldByIndex(column.Index), column, value)
+}
+
+func (converter *NetConverter) setField(fld reflect.Value, column Column, value interface{}) (err error) {
+	if !fld.IsValid() {
+		return
 	}
-	scanner.FieldValues[scanner.FieldName] = value
+	switch v := value.(type) {
+	case nil:
+		fld.Set(reflect.Zero(converter.GoType))
+		return
+	case []byte:
+		value, err = converter.parse(string(v))
+	case string:
+		value, err = converter.parse(v)
+	case *net.IPNet:
+		if v != nil {
+			value = *v
+		}
+	}
+	if err != nil {
+		return
+	}
+	if reflect.TypeOf(value) != converter.GoType {
+		return errors.New(fmt.Sprintf("cannot assign '%v' (%T) to %s column %s.%s",
+			value, value, converter.GoType, column.Kind.Kind, column.FieldName))
+	}
+	fld.Set(reflect.ValueOf(value))
 	return
 }
 
-// - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - -
+// -- P O I N T E R S -------------------------------------------------------
 
-func (converter *BasicConverter) SQLType(column Column) string {
-	return converter.sqlType
+// fieldConverter is implemented by the converters that PointerConverter can
+// delegate to.
+type fieldConverter interface {
+	Converter
+	fieldValue(reflect.Value, Column) (interface{}, error)
+	setField(reflect.Value, Column, interface{}) error
 }
 
-func (converter *BasicConverter) SQLTextOut(column Column) string {
+// PointerConverter maps pointers to basic and Enum types to nullable
+// columns. A nil pointer is stored as NULL, and NULL is scanned back as nil.
+type PointerConverter struct {
+	Element fieldConverter
+	GoType  reflect.Type
+}
+
+// MakePointerConverter returns a PointerConverter for the pointer type t, or
+// nil if the type t points to has no converter that supports it.
+func MakePointerConverter(t reflect.Type) Converter {
+	if element, ok := GetConverterForType(t.Elem()).(fieldConverter); ok {
+		return &PointerConverter{Element: element, GoType: t}
+	}
+	return nil
+}
+
+func (converter *PointerConverter) SQLType(column Column) string {
+	return converter.Element.SQLType(column)
+}
+
+func (converter *PointerConverter) SQLTextOut(column Column) string {
 	return "__count__"
 }
 
-func (converter *BasicConverter) Value(e Persistable, column Column) ([]interface{}, error) {
-	v := reflect.ValueOf(e).Elem()
-	return []interface{}{v.FieldByIndex(column.Index).Interface()}, nil
+func (converter *PointerConverter) Value(e Persistable, column Column) (values []interface{}, err error) {
+	fld := reflect.ValueOf(e).Elem().FieldByIndex(column.Index)
+	if fld.IsNil() {
+		values = []interface{}{nil}
+		return
+	}
+	value, err := converter.Element.fieldValue(fld.Elem(), column)
+	if err != nil {
+		return
+	}
+	values = []interface{}{value}
+	return
 }
 
-func (converter *BasicConverter) SQLTextIn(column Column, alias string, with bool) string {
+func (converter *PointerConverter) SQLTextIn(column Column, alias string, with bool) string {
 	if alias != "" {
 		alias = alias + "."
 	}
-	return fmt.Sprintf("%s\"%s\"", alias, column.ColumnName)
+	return fmt.Sprintf("%s%q", alias, column.ColumnName)
 }
 
-func (converter *BasicConverter) Scanners(column Column, scanners []interface{}, values map[string]interface{}) ([]interface{}, error) {
+func (converter *PointerConverter) Scanners(column Column, scanners []interface{}, values map[string]interface{}) ([]interface{}, error) {
 	return append(scanners, &BasicScanner{FieldName: column.FieldName, FieldValues: values}), nil
 }
 
-func (converter *BasicConverter) SetValue(e Persistable, column Column, value interface{}) (err error) {
-	v := reflect.ValueOf(e)
-	if v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
-		v = v.Elem()
+func (converter *PointerConverter) SetValue(e Persistable, column Column, value interface{}) (err error) {
+	fld := reflect.ValueOf(e).Elem().FieldByIndex(column.Index)
+	if !fld.IsValid() {
+		return
 	}
-	fld := v.FieldByIndex(column.Index)
-	if fld.IsValid() {
-		defer func() {
-			if e := recover(); e != nil {
-				err = errors.New(fmt.Sprintf("%v", e))
-			}
+	v := reflect.ValueOf(value)
+	switch {
+	case value == nil || (v.Kind() == reflect.Ptr && v.IsNil()):
+		fld.Set(reflect.Zero(converter.GoType))
+	case v.Type() == converter.GoType:
+		fld.Set(v)
+	default:
+		p := reflect.New(converter.GoType.Elem())
+		if err = converter.Element.setField(p.Elem(), column, value); err != nil {
 			return
-		}()
-		switch vv := value.(type) {
-		case string:
-			switch fld.Kind() {
-			case reflect.String:
-				fld.Set(reflect.ValueOf(value))
-			case reflect.Int:
-				if i, err := strconv.ParseInt(vv, 10, 64); err != nil {
-					panic(fmt.Sprintf("can't convert %q to int", vv))
-				} else {
-					fld.Set(reflect.ValueOf(int(i)))
-				}
-			case reflect.Int32:
-				if i, err := strconv.ParseInt(vv, 10, 32); err != nil {
-					panic(fmt.Sprintf("can't convert %q to int32", vv))
-				} else {
-					fld.Set(reflect.ValueOf(int32(i)))
-				}
-			case reflect.Int64:
-				if i, err := strconv.ParseInt(vv, 10, 32); err != nil {
-					panic(fmt.Sprintf("can't convert %q to int64", vv))
-				} else {
-					fld.Set(reflect.ValueOf(i))
-				}
-			case reflect.Float32:
-				if f, err := strconv.ParseFloat(vv, 32); err != nil {
-					panic(fmt.Sprintf("can't convert %q to float32", vv))
-				} else {
-					fld.Set(reflect.ValueOf(float32(f)))
-				}
-			case reflect.Float64:
-				if f, err := strconv.ParseFloat(vv, 64); err != nil {
-					panic(fmt.Sprintf("can't convert %q to float64", vv))
-				} else {
-					fld.Set(reflect.ValueOf(f))
-				}
-			case reflect.Bool:
-				if b, err := strconv.ParseBool(vv); err != nil {
-					panic(fmt.Sprintf("can't convert %q to bool", vv))
-				} else {
-					fld.Set(reflect.ValueOf(b))
-				}
-			case reflect.Struct:
-				if converter.GoType == reflect.TypeOf(time.Time{}) {
-					if t, err := time.Parse("2006-01-02", vv); err != nil {
-						panic(fmt.Sprintf("can't convert %q to Time", vv))
-					} else {
-						fld.Set(reflect.ValueOf(t))
-					}
-				} else {
-					log.Println(column.ColumnName, vv)
-				}
-			default:
-				panic(fmt.Sprintf("cannot convert strings to objects of kind %q", fld.Kind()))
-			}
-		case float64:
-			switch fld.Kind() {
-			case reflect.String:
-				fld.Set(reflect.ValueOf(strconv.FormatFloat(vv, 'g', -1, 64)))
-			case reflect.Int:
-				fld.Set(reflect.ValueOf(int(math.Round(vv))))
-			case reflect.Int32:
-				fld.Set(reflect.ValueOf(int32(math.Round(vv))))
-			case reflect.Int64:
-				fld.Set(reflect.ValueOf(int64(math.Round(vv))))
-			case reflect.Float32:
-				fld.Set(reflect.ValueOf(float32(vv)))
-			case reflect.Float64:
-				fld.Set(reflect.ValueOf(vv))
-			case reflect.Bool:
-				fld.Set(reflect.ValueOf(vv != 0.0))
-			default:
-				panic(fmt.Sprintf("cannot convert floats to objects of kind %q", fld.Kind()))
-			}
-		case float32:
-			vv64 := float64(vv)
-			switch fld.Kind() {
-			case reflect.String:
-				fld.Set(reflect.ValueOf(strconv.FormatFloat(vv64, 'g', -1, 32)))
-			case reflect.Int:
-				fld.Set(reflect.ValueOf(int(math.Round(vv64))))
-			case reflect.Int32:
-				fld.Set(reflect.ValueOf(int32(math.Round(vv64))))
-			case reflect.Int64:
-				fld.Set(reflect.ValueOf(int64(math.Round(vv64))))
-			case reflect.Float32:
-				fld.Set(reflect.ValueOf(vv))
-			case reflect.Float64:
-				fld.Set(reflect.ValueOf(vv64))
-			case reflect.Bool:
-				fld.Set(reflect.ValueOf(vv != 0.0))
-			default:
-				panic(fmt.Sprintf("cannot convert floats to objects of kind %q", fld.Kind()))
-			}
-		case int:
-			switch fld.Kind() {
-			case reflect.String:
-				fld.Set(reflect.ValueOf(strconv.FormatInt(int64(vv), 10)))
-			case reflect.Int:
-				fld.Set(reflect.ValueOf(vv))
-			case reflect.Int32:
-				fld.Set(reflect.ValueOf(int32(vv)))
-			case reflect.Int64:
-				fld.Set(reflect.ValueOf(int64(vv)))
-			case reflect.Float32:
-				fld.Set(reflect.ValueOf(float32(vv)))
-			case reflect.Float64:
-				fld.Set(reflect.ValueOf(float64(vv)))
-			case reflect.Bool:
-				fld.Set(reflect.ValueOf(vv != 0))
-			default:
-				panic(fmt.Sprintf("cannot convert integers to objects of kind %q", fld.Kind()))
-			}
-		case int32:
-			switch fld.Kind() {
-			case reflect.String:
-				fld.Set(reflect.ValueOf(strconv.FormatInt(int64(vv), 10)))
-			case reflect.Int:
-				fld.Set(reflect.ValueOf(int(vv)))
-			case reflect.Int32:
-				fld.Set(reflect.ValueOf(vv))
-			case reflect.Int64:
-				fld.Set(reflect.ValueOf(int64(vv)))
-			case reflect.Float32:
-				fld.Set(reflect.ValueOf(float32(vv)))
-			case reflect.Float64:
-				fld.Set(reflect.ValueOf(float64(vv)))
-			case reflect.Bool:
-				fld.Set(reflect.ValueOf(vv != 0))
-			default:
-				panic(fmt.Sprintf("cannot convert integers to objects of kind %q", fld.Kind()))
-			}
-		case int64:
-			switch fld.Kind() {
-			case reflect.String:
-				fld.Set(reflect.ValueOf(strconv.FormatInt(vv, 10)))
-			case reflect.Int:
-				fld.Set(reflect.ValueOf(int(vv)))
-			case reflect.Int32:
-				fld.Set(reflect.ValueOf(int32(vv)))
-			case reflect.Int64:
-				fld.Set(reflect.ValueOf(vv))
-			case reflect.Float32:
-				fld.Set(reflect.ValueOf(float32(vv)))
-			case reflect.Float64:
-				fld.Set(reflect.ValueOf(float64(vv)))
-			case reflect.Bool:
-				fld.Set(reflect.ValueOf(vv != 0))
-			default:
-				panic(fmt.Sprintf("cannot convert integers to objects of kind %q", fld.Kind()))
-			}
-		default:
-			fld.Set(reflect.ValueOf(vv))
 		}
+		fld.Set(p)
 	}
 	return
 }
@@ -367,6 +1351,11 @@ func (ref *ReferenceConverter) SetValue(e Persistable, column Column, value inte
 		if err != nil {
 			return err
 		}
+	case *Key:
+		reference, err = e.Manager().Get(r.Kind(), r.Id())
+		if err != nil {
+			return err
+		}
 	case Persistable:
 		reference = r
 	case string:
@@ -401,3 +1390,114 @@ func (ref *ReferenceConverter) SetValue(e Persistable, column Column, value inte
 	fld.Set(reflect.ValueOf(reference))
 	return nil
 }
+
+// - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - -
+
+// PolymorphicReferenceConverter maps fields of an interface type, like
+// Subject Persistable, that can reference entities of unrelated Kinds. The
+// column stores the Kind of the referenced entity along with its id, and
+// scanning resolves that Kind. If the field has a polymorphic tag, a comma
+// separated list of Kinds, referenced entities must derive from one of them.
+type PolymorphicReferenceConverter struct {
+	GoType    reflect.Type
+	KindNames []string
+}
+
+// Kinds returns the Kinds the field can reference, or nil if it can
+// reference any Kind implementing its type.
+func (ref *PolymorphicReferenceConverter) Kinds() (kinds []*Kind) {
+	for _, name := range ref.KindNames {
+		if k := GetKind(strings.TrimSpace(name)); k != nil {
+			kinds = append(kinds, k)
+		}
+	}
+	return
+}
+
+func (ref *PolymorphicReferenceConverter) allows(k *Kind) (err error) {
+	if !reflect.PtrTo(k.typ).Implements(ref.GoType) {
+		return errors.New(fmt.Sprintf("kind '%s' does not implement %s", k.Kind, ref.GoType))
+	}
+	if len(ref.KindNames) == 0 {
+		return
+	}
+	for _, allowed := range ref.Kinds() {
+		if k.DerivesFrom(allowed) {
+			return
+		}
+	}
+	return errors.New(fmt.Sprintf("kind '%s' is not one of %s", k.Kind, strings.Join(ref.KindNames, ", ")))
+}
+
+func (ref *PolymorphicReferenceConverter) SQLType(column Column) string {
+	pg := GetPostgreSQLAdapter()
+	return fmt.Sprintf("\"%s\".\"Reference\"", pg.Schema)
+}
+
+func (ref *PolymorphicReferenceConverter) SQLTextOut(column Column) string {
+	return "__count__"
+}
+
+func (ref *PolymorphicReferenceConverter) Value(e Persistable, column Column) (values []interface{}, err error) {
+	fieldValue := reflect.ValueOf(e).Elem().FieldByIndex(column.Index)
+	if fieldValue.IsNil() {
+		values = []interface{}{ZeroKey.String()}
+		return
+	}
+	reference := fieldValue.Interface().(Persistable)
+	if err = ref.allows(reference.Kind()); err != nil {
+		return
+	}
+	values = []interface{}{reference.AsKey().String()}
+	return
+}
+
+func (ref *PolymorphicReferenceConverter) SQLTextIn(column Column, alias string, with bool) string {
+	if alias != "" {
+		alias = alias + "."
+	}
+	return fmt.Sprintf("%s%q", alias, column.ColumnName)
+}
+
+func (ref *PolymorphicReferenceConverter) Scanners(column Column, scanners []interface{}, values map[string]interface{}) ([]interface{}, error) {
+	scanner := new(ReferenceScanner)
+	scanner.FieldName = column.FieldName
+	scanner.FieldValues = values
+	return append(scanners, scanner), nil
+}
+
+func (ref *PolymorphicReferenceConverter) SetValue(e Persistable, column Column, value interface{}) (err error) {
+	fld := reflect.ValueOf(e).Elem().FieldByIndex(column.Index)
+	var reference Persistable
+	switch r := value.(type) {
+	case nil:
+	case *Key:
+		if !r.IsZero() {
+			reference, err = e.Manager().Make(r.Kind(), r.Parent(), r.Id())
+		}
+	case Persistable:
+		if !r.AsKey().IsZero() {
+			reference = r
+		}
+	case string:
+		var key *Key
+		if key, err = ParseKey(r); err != nil {
+			return
+		}
+		return ref.SetValue(e, column, key)
+	default:
+		err = errors.New(fmt.Sprintf("cannot assign %v (%T) to column %s.%s", value, value, column.Kind.Kind, column.FieldName))
+	}
+	if err != nil {
+		return
+	}
+	if reference == nil {
+		fld.Set(reflect.Zero(fld.Type()))
+		return
+	}
+	if err = ref.allows(reference.Kind()); err != nil {
+		return
+	}
+	fld.Set(reflect.ValueOf(reference))
+	return
+}
@@ -2,6 +2,7 @@ package grumble
 
 import (
 	"bytes"
+	"context"
 	"database/sql"
 	"encoding/json"
 	"errors"
@@ -55,13 +56,23 @@ var defaultAdapter = PostgreSQLAdapter{
 var adapter *PostgreSQLAdapter
 
 type SQLColumn struct {
-	Name       string
-	SQLType    string
-	Default    string
-	Nullable   bool
-	PrimaryKey bool
-	Unique     bool
-	Indexed    bool
+	Name        string
+	SQLType     string
+	Default     string
+	Nullable    bool
+	PrimaryKey  bool
+	Unique      bool
+	Indexed     bool
+	IndexMethod string
+	Generated   string
+	RenamedFrom []string
+}
+
+func (column SQLColumn) indexUsing() string {
+	if column.IndexMethod == "" {
+		return ""
+	}
+	return " USING " + column.IndexMethod
 }
 
 type SQLIndex struct {
@@ -77,6 +88,7 @@ type SQLTable struct {
 	TableName     string
 	Columns       []SQLColumn
 	Indexes       []SQLIndex
+	RenamedFrom   []string
 	columnsByName map[string]int
 	indexesByName map[string]int
 }
@@ -320,7 +332,39 @@ func (pg PostgreSQLAdapter) runTX(admin bool, work func(*sql.DB) error) (err err
 	})
 }
 
-func (pg PostgreSQLAdapter) runSQLFile(conn *sql.DB, sqlFile string) (err error) {
+// Transaction runs work in a transaction of its own, which is committed if
+// work succeeds and rolled back if it fails. Unlike TX, which hands work the
+// connection, every statement work executes on tx is part of the
+// transaction.
+func (pg PostgreSQLAdapter) Transaction(work func(tx *sql.Tx) error) error {
+	return pg.runTransaction(nil, work)
+}
+
+func (pg PostgreSQLAdapter) runTransaction(opts *sql.TxOptions, work func(*sql.Tx) error) error {
+	return pg.doWork(false, func(conn *sql.DB) (err error) {
+		tx, err := conn.BeginTx(context.Background(), opts)
+		if err != nil {
+			return
+		}
+		defer func() {
+			if err == nil {
+				err = tx.Commit()
+			} else if e := tx.Rollback(); e != nil {
+				log.Printf("Error rolling back transaction: '%s'", e)
+			}
+		}()
+		return work(tx)
+	})
+}
+
+// sqlExecutor is the part of the API shared by *sql.DB and *sql.Tx.
+type sqlExecutor interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+func (pg PostgreSQLAdapter) runSQLFile(conn sqlExecutor, sqlFile string) (err error) {
 	err = nil
 	if sqlFile != "" {
 		var templateText []byte
@@ -443,6 +487,126 @@ func (pg PostgreSQLAdapter) makeTable(tableName string) SQLTable {
 	return ret
 }
 
+// referenceColumn is a column of type Reference, or Reference[] if array is
+// set, in the schema of the adapter.
+type referenceColumn struct {
+	table, column string
+	array         bool
+}
+
+func (pg PostgreSQLAdapter) referenceColumns(conn *sql.DB) (columns []referenceColumn, err error) {
+	rows, err := conn.Query(`SELECT table_name, column_name, udt_name FROM information_schema.columns
+		WHERE table_schema = $1 AND udt_schema = $1 AND udt_name IN ('Reference', '_Reference')`, pg.GetSchema())
+	if err != nil {
+		return
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+	for rows.Next() {
+		var column referenceColumn
+		var udtName string
+		if err = rows.Scan(&column.table, &column.column, &udtName); err != nil {
+			return
+		}
+		column.array = udtName == "_Reference"
+		columns = append(columns, column)
+	}
+	err = rows.Err()
+	return
+}
+
+// ReconcileReferenceType widens the "id" attribute of the Reference type to
+// bigint in schemas created when it was an integer, so that references to
+// entities with bigserial ids fit. PostgreSQL can't alter a composite type
+// used by columns, so these are converted to text while the type is altered.
+func (pg PostgreSQLAdapter) ReconcileReferenceType() error {
+	return pg.TX(func(conn *sql.DB) (err error) {
+		var dataType string
+		err = conn.QueryRow(`SELECT data_type FROM information_schema.attributes
+			WHERE udt_schema = $1 AND udt_name = 'Reference' AND attribute_name = 'id'`, pg.GetSchema()).Scan(&dataType)
+		switch {
+		case err == sql.ErrNoRows:
+			return nil
+		case err != nil || dataType != "integer":
+			return
+		}
+		columns, err := pg.referenceColumns(conn)
+		if err != nil {
+			return
+		}
+		alter := func(column referenceColumn, sqlType string) (err error) {
+			if column.array {
+				sqlType += "[]"
+			}
+			_, err = conn.Exec(fmt.Sprintf("ALTER TABLE %q.%q ALTER COLUMN %q TYPE %s USING %q::%s",
+				pg.GetSchema(), column.table, column.column, sqlType, column.column, sqlType))
+			return
+		}
+		for _, column := range columns {
+			if err = alter(column, "text"); err != nil {
+				return
+			}
+		}
+		if _, err = conn.Exec(fmt.Sprintf("ALTER TYPE %q.\"Reference\" ALTER ATTRIBUTE \"id\" TYPE bigint", pg.GetSchema())); err != nil {
+			return
+		}
+		for _, column := range columns {
+			if err = alter(column, fmt.Sprintf("%q.\"Reference\"", pg.GetSchema())); err != nil {
+				return
+			}
+		}
+		return
+	})
+}
+
+// ReconcileEnum creates the ENUM type with the given name and values in the
+// adapter's schema. If the type exists, the values it is missing are added.
+// Values are never removed, since columns can still hold them.
+func (pg PostgreSQLAdapter) ReconcileEnum(name string, values []string) error {
+	return pg.TX(func(conn *sql.DB) (err error) {
+		rows, err := conn.Query(`SELECT e.enumlabel
+				FROM pg_type t
+				INNER JOIN pg_namespace n ON n.oid = t.typnamespace
+				LEFT JOIN pg_enum e ON e.enumtypid = t.oid
+				WHERE n.nspname = $1 AND t.typname = $2`, pg.GetSchema(), name)
+		if err != nil {
+			return
+		}
+		exists := false
+		labels := make(map[string]bool)
+		for rows.Next() {
+			var label sql.NullString
+			if err = rows.Scan(&label); err != nil {
+				rows.Close()
+				return
+			}
+			exists = true
+			if label.Valid {
+				labels[label.String] = true
+			}
+		}
+		rows.Close()
+		qualified := fmt.Sprintf("%q.%q", pg.GetSchema(), name)
+		if !exists {
+			quoted := make([]string, len(values))
+			for ix, value := range values {
+				quoted[ix] = pq.QuoteLiteral(value)
+			}
+			_, err = conn.Exec(fmt.Sprintf("CREATE TYPE %s AS ENUM ( %s )", qualified, strings.Join(quoted, ", ")))
+			return
+		}
+		for _, value := range values {
+			if !labels[value] {
+				if _, err = conn.Exec(fmt.Sprintf("ALTER TYPE %s ADD VALUE %s", qualified, pq.QuoteLiteral(value))); err != nil {
+					return
+				}
+			}
+		}
+		return
+	})
+}
+
 func (table SQLTable) QualifiedName() string {
 	return fmt.Sprintf("%q.%q", table.Schema, table.TableName)
 }
@@ -598,9 +762,15 @@ func (table *SQLTable) syncConstraints(conn *sql.DB) (err error) {
 }
 
 func (table *SQLTable) syncColumns(conn *sql.DB) (err error) {
-	s := `SELECT column_name, column_default, is_nullable, data_type 
-				FROM information_schema.columns 
-				WHERE table_schema = $1 AND table_name = $2`
+	s := `SELECT c.column_name, c.column_default, c.is_nullable, c.data_type, c.udt_schema, c.udt_name,
+				       c.numeric_precision, c.numeric_scale, e.data_type, e.udt_schema, e.udt_name,
+				       c.is_generated, c.generation_expression,
+				       col_description(format('%I.%I', c.table_schema, c.table_name)::regclass, c.ordinal_position)
+				FROM information_schema.columns c
+				LEFT JOIN information_schema.element_types e
+				  ON ((c.table_catalog, c.table_schema, c.table_name, 'TABLE', c.dtd_identifier)
+				    = (e.object_catalog, e.object_schema, e.object_name, e.object_type, e.collection_type_identifier))
+				WHERE c.table_schema = $1 AND c.table_name = $2`
 	var rows *sql.Rows
 	rows, err = conn.Query(s, table.Schema, table.TableName)
 	if err != nil {
@@ -610,12 +780,37 @@ func (table *SQLTable) syncColumns(conn *sql.DB) (err error) {
 			var col = SQLColumn{}
 			var nullable string
 			var columnDefault sql.NullString
-			if err = rows.Scan(&col.Name, &columnDefault, &nullable, &col.SQLType); err != nil {
+			var udtSchema, udtName string
+			var precision, scale sql.NullInt64
+			var elementType, elementSchema, elementName sql.NullString
+			var isGenerated string
+			var generation, description sql.NullString
+			if err = rows.Scan(&col.Name, &columnDefault, &nullable, &col.SQLType, &udtSchema, &udtName,
+				&precision, &scale, &elementType, &elementSchema, &elementName,
+				&isGenerated, &generation, &description); err != nil {
 				return
 			}
+			if isGenerated == "ALWAYS" {
+				col.Generated = generation.String
+				if description.Valid {
+					col.Generated = description.String
+				}
+			}
+			switch {
+			case col.SQLType == "USER-DEFINED":
+				col.SQLType = fmt.Sprintf("%q.%q", udtSchema, udtName)
+			case col.SQLType == "ARRAY" && elementType.String == "USER-DEFINED":
+				col.SQLType = fmt.Sprintf("%q.%q[]", elementSchema.String, elementName.String)
+			case col.SQLType == "ARRAY" && elementType.Valid:
+				col.SQLType = elementType.String + "[]"
+			case col.SQLType == "numeric" && precision.Valid:
+				col.SQLType = fmt.Sprintf("numeric(%d,%d)", precision.Int64, scale.Int64)
+			}
 			if columnDefault.Valid {
 				if strings.Index(columnDefault.String, "nextval") == 0 && col.SQLType == "integer" {
 					col.SQLType = "serial"
+				} else if strings.Index(columnDefault.String, "nextval") == 0 && col.SQLType == "bigint" {
+					col.SQLType = "bigserial"
 				} else {
 					col.Default = columnDefault.String
 					ix := strings.Index(col.Default, "::")
@@ -712,12 +907,16 @@ func (table *SQLTable) AddIndex(index SQLIndex) (err error) {
 	}
 	if len(index.Columns) == 1 {
 		c := table.GetColumnByName(index.Columns[0])
-		if index.PrimaryKey {
+		switch {
+		case index.PrimaryKey:
 			c.Indexed = false
 			c.Unique = false
 			c.Nullable = false
 			c.PrimaryKey = true
-		} else {
+		case index.Unique:
+			c.Indexed = false
+			c.Unique = true
+		default:
 			c.Indexed = true
 		}
 	} else {
@@ -738,7 +937,7 @@ var createTable = SQLTemplate{Name: "CreateTable", SQL: `{{$Table := .TableName}
 {{define "indexcolumns"}}({{range $i, $col := .Columns}}{{if gt $i 0}}, {{end}}"{{$col}}"{{end}}){{end}}
 CREATE TABLE {{$Qualified}} (
   {{range $i, $c := .Columns}}
-    {{if gt $i 0}},{{end}}"{{$c.Name}}" {{$c.SQLType}}{{$l := len $c.Default}}{{if gt $l 0}} DEFAULT {{$c.Default}}{{end}}{{if not $c.Nullable}} NOT NULL{{end}}{{if $c.Unique}} UNIQUE{{end}}{{if $c.PrimaryKey}} PRIMARY KEY{{end}}
+    {{if gt $i 0}},{{end}}"{{$c.Name}}" {{$c.SQLType}}{{if $c.Generated}} GENERATED ALWAYS AS ({{$c.Generated}}) STORED{{end}}{{$l := len $c.Default}}{{if gt $l 0}} DEFAULT {{$c.Default}}{{end}}{{if not $c.Nullable}} NOT NULL{{end}}{{if $c.Unique}} UNIQUE{{end}}{{if $c.PrimaryKey}} PRIMARY KEY{{end}}
   {{end}}
   {{range .Indexes}}
     {{if .PrimaryKey}}, CONSTRAINT "{{.Name}}" PRIMARY KEY {{template "indexcolumns" .}}{{end}}
@@ -746,7 +945,7 @@ CREATE TABLE {{$Qualified}} (
 );
   {{range $c := .Columns}}
 	{{if $c.Indexed}}
-CREATE INDEX "{{$Table}}_{{$c.Name}}" ON {{$Qualified}} ("{{$c.Name}}");
+CREATE INDEX "{{$Table}}_{{$c.Name}}" ON {{$Qualified}}{{if $c.IndexMethod}} USING {{$c.IndexMethod}}{{end}} ("{{$c.Name}}");
     {{end}}
   {{end}}
   {{range .Indexes}}
@@ -755,12 +954,34 @@ CREATE INDEX "{{$Table}}_{{$c.Name}}" ON {{$Qualified}} ("{{$c.Name}}");
 `}
 
 func (table SQLTable) create(conn *sql.DB) (err error) {
-	return createTable.Exec(conn, table)
+	if err = createTable.Exec(conn, table); err != nil {
+		return
+	}
+	for _, column := range table.Columns {
+		if column.Generated != "" {
+			if err = table.commentGenerated(conn, column); err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+// commentGenerated stores the expression of a generated column as the
+// comment of the column. PostgreSQL normalizes the expressions it reports,
+// so the comment is what Reconcile compares against.
+func (table SQLTable) commentGenerated(conn *sql.DB, column SQLColumn) (err error) {
+	_, err = conn.Exec(fmt.Sprintf("COMMENT ON COLUMN %s.%q IS %s",
+		table.QualifiedName(), column.Name, pq.QuoteLiteral(column.Generated)))
+	return
 }
 
 func (table SQLTable) alterAddColumn(conn *sql.DB, column SQLColumn) (err error) {
 	s := fmt.Sprintf("ALTER TABLE %s ADD COLUMN \"%s\" %s",
 		table.QualifiedName(), column.Name, column.SQLType)
+	if column.Generated != "" {
+		s += fmt.Sprintf(" GENERATED ALWAYS AS (%s) STORED", column.Generated)
+	}
 	if !column.Nullable {
 		s += " NOT NULL"
 	}
@@ -776,9 +997,14 @@ func (table SQLTable) alterAddColumn(conn *sql.DB, column SQLColumn) (err error)
 	if _, err = conn.Exec(s); err != nil {
 		return
 	}
+	if column.Generated != "" {
+		if err = table.commentGenerated(conn, column); err != nil {
+			return
+		}
+	}
 	if column.Indexed && !column.PrimaryKey {
-		s = fmt.Sprintf("CREATE INDEX \"%s_%s\" on %s ( \"%s\" )",
-			table.TableName, column.Name, table.QualifiedName(), column.Name)
+		s = fmt.Sprintf("CREATE INDEX \"%s_%s\" on %s%s ( \"%s\" )",
+			table.TableName, column.Name, table.QualifiedName(), column.indexUsing(), column.Name)
 		if _, err = conn.Exec(s); err != nil {
 			return
 		}
@@ -787,11 +1013,7 @@ func (table SQLTable) alterAddColumn(conn *sql.DB, column SQLColumn) (err error)
 }
 
 func (table SQLTable) alterDropColumn(conn *sql.DB, column SQLColumn) (err error) {
-	if column.Indexed {
-		if err = table.alterAddColumnIndex(conn, column); err != nil {
-			return
-		}
-	}
+	// Dropping the column drops its index as well.
 	s := fmt.Sprintf("ALTER TABLE %s DROP COLUMN \"%s\"", table.QualifiedName(), column.Name)
 	_, err = conn.Exec(s)
 	return
@@ -802,8 +1024,8 @@ func (table SQLTable) alterAddColumnIndex(conn *sql.DB, column SQLColumn) (err e
 	if column.Unique {
 		unique = "UNIQUE "
 	}
-	s := fmt.Sprintf("CREATE %sINDEX \"%s_%s\" ON %s (\"%s\")",
-		unique, table.TableName, column.Name, table.QualifiedName(), column.Name)
+	s := fmt.Sprintf("CREATE %sINDEX \"%s_%s\" ON %s%s (\"%s\")",
+		unique, table.TableName, column.Name, table.QualifiedName(), column.indexUsing(), column.Name)
 	_, err = conn.Exec(s)
 	return
 }
@@ -831,12 +1053,114 @@ func (table SQLTable) alterDropIndex(conn *sql.DB, index string) (err error) {
 	return
 }
 
-func (table SQLTable) reconcileColumn(conn *sql.DB, newColumn SQLColumn, oldColumn *SQLColumn) (err error) {
-	// HACK
-	if oldColumn.SQLType == "ARRAY" || oldColumn.SQLType == "USER-DEFINED" {
+// integerWidths ranks the integer types a column can be widened between
+// without losing data.
+var integerWidths = map[string]int{
+	"smallint":      1,
+	"integer":       2,
+	"serial":        2,
+	"bigint":        3,
+	"bigserial":     3,
+	"numeric(20,0)": 4,
+}
+
+// sqlTypeAliases maps the spellings of types PostgreSQL accepts to the
+// names information_schema reports for them.
+var sqlTypeAliases = map[string]string{
+	"int":         "integer",
+	"int2":        "smallint",
+	"int4":        "integer",
+	"int8":        "bigint",
+	"float8":      "double precision",
+	"float4":      "real",
+	"bool":        "boolean",
+	"varchar":     "character varying",
+	"decimal":     "numeric",
+	"timestamp":   "timestamp without time zone",
+	"timestamptz": "timestamp with time zone",
+	"time":        "time without time zone",
+	"timetz":      "time with time zone",
+	"serial4":     "serial",
+	"serial8":     "bigserial",
+}
+
+// normalizeSQLType returns sqlType in the form syncColumns builds from
+// information_schema, so that a column type declared by a converter can be
+// compared with the type of the existing column. Quotes, and the schema of
+// the table for user-defined types, are stripped, aliases are resolved, and
+// the element type of arrays is normalized the same way.
+func (table SQLTable) normalizeSQLType(sqlType string) string {
+	sqlType = strings.ToLower(strings.TrimSpace(sqlType))
+	array := strings.HasSuffix(sqlType, "[]")
+	sqlType = strings.TrimSpace(strings.TrimSuffix(sqlType, "[]"))
+	sqlType = strings.ReplaceAll(sqlType, "\"", "")
+	for _, schema := range []string{strings.ToLower(table.Schema), "public", "pg_catalog"} {
+		sqlType = strings.TrimPrefix(sqlType, schema+".")
+	}
+	if alias, ok := sqlTypeAliases[sqlType]; ok {
+		sqlType = alias
+	}
+	switch {
+	case sqlType == "numeric(20, 0)":
+		sqlType = "numeric(20,0)"
+	case strings.HasPrefix(sqlType, "character varying") && array:
+		// varchar[] and text[] are stored alike; existing columns are kept.
+		sqlType = "text"
+	}
+	if array {
+		sqlType += "[]"
+	}
+	return sqlType
+}
+
+func (table SQLTable) alterColumnType(conn *sql.DB, column SQLColumn) (err error) {
+	sqlType := column.SQLType
+	switch sqlType {
+	case "serial":
+		sqlType = "integer"
+	case "bigserial":
+		sqlType = "bigint"
+	}
+	s := fmt.Sprintf("ALTER TABLE %s ALTER COLUMN \"%s\" TYPE %s USING \"%s\"::%s",
+		table.QualifiedName(), column.Name, sqlType, column.Name, sqlType)
+	if _, err = conn.Exec(s); err != nil {
 		return
 	}
-	if newColumn.SQLType != oldColumn.SQLType {
+	if column.SQLType == "bigserial" {
+		var sequence string
+		if err = conn.QueryRow("SELECT pg_get_serial_sequence($1, $2)", table.QualifiedName(), column.Name).Scan(&sequence); err != nil {
+			return
+		}
+		_, err = conn.Exec(fmt.Sprintf("ALTER SEQUENCE %s AS bigint", sequence))
+	}
+	return
+}
+
+func (table SQLTable) reconcileColumn(conn *sql.DB, newColumn SQLColumn, oldColumn *SQLColumn) (err error) {
+	oldWidth, newWidth := integerWidths[oldColumn.SQLType], integerWidths[newColumn.SQLType]
+	switch {
+	case oldWidth > 0 && newWidth > oldWidth:
+		if err = table.alterColumnType(conn, newColumn); err != nil {
+			return
+		}
+		oldColumn.SQLType = newColumn.SQLType
+	case newWidth > 0 && oldWidth > newWidth:
+		// Narrowing could fail on existing values. The wider column can hold
+		// every value of the narrower type, so it is kept.
+		newColumn.SQLType = oldColumn.SQLType
+	}
+	if newColumn.Generated == "" && oldColumn.Generated == "" &&
+		table.normalizeSQLType(newColumn.SQLType) != table.normalizeSQLType(oldColumn.SQLType) {
+		// Converting the values in place keeps the data of the column, or
+		// fails if they can't be converted.
+		if err = table.alterColumnType(conn, newColumn); err != nil {
+			return
+		}
+		oldColumn.SQLType = newColumn.SQLType
+	}
+	if newColumn.Generated != oldColumn.Generated ||
+		table.normalizeSQLType(newColumn.SQLType) != table.normalizeSQLType(oldColumn.SQLType) {
+		// Generated columns hold no data of their own, and are recreated.
 		if err = table.alterDropColumn(conn, newColumn); err != nil {
 			return
 		}
@@ -845,6 +1169,11 @@ func (table SQLTable) reconcileColumn(conn *sql.DB, newColumn SQLColumn, oldColu
 		}
 		return
 	}
+	if newColumn.Unique && !oldColumn.Unique && !newColumn.PrimaryKey {
+		if err = table.alterAddColumnIndex(conn, newColumn); err != nil {
+			return
+		}
+	}
 	if newColumn.Indexed && !oldColumn.Indexed {
 		if err = table.alterAddColumnIndex(conn, newColumn); err != nil {
 			return
@@ -886,8 +1215,13 @@ func (table SQLTable) Reconcile() (err error) {
 			return
 		}
 		if !exists {
-			err = table.create(conn)
-			return
+			var renamed bool
+			if renamed, err = table.renameTable(conn); err != nil || !renamed {
+				if err == nil {
+					err = table.create(conn)
+				}
+				return
+			}
 		}
 		if !table.pg.Reconcile {
 			return
@@ -899,6 +1233,11 @@ func (table SQLTable) Reconcile() (err error) {
 		// Loop new columns. Create any that don't exist yet, reconcile existing ones.
 		for _, newCol := range table.Columns {
 			oldCol := current.GetColumnByName(newCol.Name)
+			if oldCol == nil {
+				if oldCol, err = table.renameColumn(conn, &current, newCol); err != nil {
+					return
+				}
+			}
 			if oldCol == nil {
 				// Column is new. Create:
 				if err = table.alterAddColumn(conn, newCol); err != nil {
@@ -950,6 +1289,82 @@ func (table SQLTable) Reconcile() (err error) {
 	return
 }
 
+// renameTable renames the first table in RenamedFrom that exists to the
+// name of the table, together with the indexes named after it. renamed is
+// false if none of the tables exist.
+func (table SQLTable) renameTable(conn *sql.DB) (renamed bool, err error) {
+	for _, name := range table.RenamedFrom {
+		previous := table.pg.makeTable(name)
+		previous.Schema = table.Schema
+		if renamed, err = previous.exists(conn); err != nil || !renamed {
+			if err != nil {
+				return
+			}
+			continue
+		}
+		if _, err = conn.Exec(fmt.Sprintf("ALTER TABLE %s RENAME TO %q", previous.QualifiedName(), table.TableName)); err != nil {
+			return
+		}
+		var rows *sql.Rows
+		if rows, err = conn.Query("SELECT indexname FROM pg_indexes WHERE schemaname = $1 AND tablename = $2",
+			table.Schema, table.TableName); err != nil {
+			return
+		}
+		indexes := make([]string, 0)
+		for rows.Next() {
+			var index string
+			if err = rows.Scan(&index); err != nil {
+				_ = rows.Close()
+				return
+			}
+			if strings.HasPrefix(index, name+"_") {
+				indexes = append(indexes, index)
+			}
+		}
+		if err = rows.Close(); err != nil {
+			return
+		}
+		for _, index := range indexes {
+			if _, err = conn.Exec(fmt.Sprintf("ALTER INDEX %q.%q RENAME TO %q",
+				table.Schema, index, table.TableName+strings.TrimPrefix(index, name))); err != nil {
+				return
+			}
+		}
+		return
+	}
+	return
+}
+
+// renameColumn renames the first column in the RenamedFrom list of column
+// that exists in current and is not a column of the table anymore to the
+// name of column. It returns the renamed column of current, or nil if no
+// column was renamed.
+func (table SQLTable) renameColumn(conn *sql.DB, current *SQLTable, column SQLColumn) (renamed *SQLColumn, err error) {
+	for _, name := range column.RenamedFrom {
+		if table.GetColumnByName(name) != nil {
+			continue
+		}
+		ix, ok := current.columnsByName[name]
+		if !ok {
+			continue
+		}
+		if _, err = conn.Exec(fmt.Sprintf("ALTER TABLE %s RENAME COLUMN %q TO %q",
+			table.QualifiedName(), name, column.Name)); err != nil {
+			return
+		}
+		if _, err = conn.Exec(fmt.Sprintf("ALTER INDEX IF EXISTS %q.%q RENAME TO %q",
+			table.Schema, table.TableName+"_"+name, table.TableName+"_"+column.Name)); err != nil {
+			return
+		}
+		renamed = &current.Columns[ix]
+		renamed.Name = column.Name
+		delete(current.columnsByName, name)
+		current.columnsByName[column.Name] = ix
+		return
+	}
+	return
+}
+
 func (table SQLTable) Drop() (err error) {
 	return table.pg.TX(func(db *sql.DB) (err error) {
 		s := fmt.Sprintf("DROP TABLE IF EXISTS %s CASCADE", table.QualifiedName())
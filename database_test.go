@@ -3,6 +3,7 @@ package grumble
 import (
 	"errors"
 	"fmt"
+	"reflect"
 	"testing"
 )
 
@@ -111,8 +112,10 @@ func equals(table1 SQLTable, table2 SQLTable) (bool, error) {
 		if c2 == nil {
 			return false, errors.New(fmt.Sprintf("Column '%s' not found in table2", c1.Name))
 		}
-		if c1 != *c2 {
-			return false, errors.New(fmt.Sprintf("Column '%s': %v != %v", c1.Name, c1, *c2))
+		col2 := *c2
+		c1.RenamedFrom, col2.RenamedFrom = nil, nil
+		if !reflect.DeepEqual(c1, col2) {
+			return false, errors.New(fmt.Sprintf("Column '%s': %v != %v", c1.Name, c1, col2))
 		}
 	}
 	for _, i1 := range table1.Indexes {
@@ -331,3 +334,20 @@ func TestSQLTable_Sync_2(t *testing.T) {
 		t.Error("Current and original table different", err)
 	}
 }
+
+func TestSQLTable_NormalizeSQLType(t *testing.T) {
+	table := SQLTable{TableName: TableName2, Schema: "Test"}
+	for _, types := range [][2]string{
+		{"text[]", "text[]"},
+		{"character varying[]", "text[]"},
+		{"timestamp[]", "timestamp without time zone[]"},
+		{"int8", "bigint"},
+		{"\"Test\".\"TaskStatus\"", "taskstatus"},
+		{"\"Test\".\"Reference\"[]", "reference[]"},
+		{"\"TaskStatus\"", "taskstatus"},
+	} {
+		if normalized := table.normalizeSQLType(types[0]); normalized != types[1] {
+			t.Errorf("normalizeSQLType(%q) = %q, expected %q", types[0], normalized, types[1])
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package grumble
+
+import (
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// Decimal is an exact decimal number, for amounts of money and other values
+// that should not be subject to binary floating point rounding. Decimal
+// fields are stored in numeric columns. The precision and scale of the
+// column can be set with the 'precision' and 'scale' tags. The zero value of
+// Decimal is 0.
+type Decimal struct {
+	rat *big.Rat
+}
+
+func pow10(n int) *big.Int {
+	return new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(n)), nil)
+}
+
+// NewDecimal returns the Decimal unscaled * 10^-scale.
+func NewDecimal(unscaled int64, scale int) Decimal {
+	r := new(big.Rat).SetInt64(unscaled)
+	if scale > 0 {
+		r.Quo(r, new(big.Rat).SetInt(pow10(scale)))
+	} else if scale < 0 {
+		r.Mul(r, new(big.Rat).SetInt(pow10(-scale)))
+	}
+	return Decimal{rat: r}
+}
+
+// ParseDecimal parses a decimal number like "-12.50" or "1e3".
+func ParseDecimal(s string) (d Decimal, err error) {
+	r, ok := new(big.Rat).SetString(strings.TrimSpace(s))
+	if !ok || strings.Contains(s, "/") {
+		err = errors.New(fmt.Sprintf("can't convert %q to Decimal", s))
+		return
+	}
+	d.rat = r
+	return
+}
+
+// DecimalFromFloat returns the Decimal with the shortest decimal
+// representation that converts back to f.
+func DecimalFromFloat(f float64) Decimal {
+	d, _ := ParseDecimal(strconv.FormatFloat(f, 'f', -1, 64))
+	return d
+}
+
+func (d Decimal) r() *big.Rat {
+	if d.rat == nil {
+		return new(big.Rat)
+	}
+	return d.rat
+}
+
+// Rat returns the value of d as a big.Rat.
+func (d Decimal) Rat() *big.Rat {
+	return new(big.Rat).Set(d.r())
+}
+
+func (d Decimal) Add(other Decimal) Decimal {
+	return Decimal{rat: new(big.Rat).Add(d.r(), other.r())}
+}
+
+func (d Decimal) Sub(other Decimal) Decimal {
+	return Decimal{rat: new(big.Rat).Sub(d.r(), other.r())}
+}
+
+func (d Decimal) Mul(other Decimal) Decimal {
+	return Decimal{rat: new(big.Rat).Mul(d.r(), other.r())}
+}
+
+func (d Decimal) Neg() Decimal {
+	return Decimal{rat: new(big.Rat).Neg(d.r())}
+}
+
+func (d Decimal) Cmp(other Decimal) int {
+	return d.r().Cmp(other.r())
+}
+
+func (d Decimal) Equal(other Decimal) bool {
+	return d.Cmp(other) == 0
+}
+
+func (d Decimal) Sign() int {
+	return d.r().Sign()
+}
+
+func (d Decimal) IsZero() bool {
+	return d.Sign() == 0
+}
+
+// Scale returns the number of digits after the decimal point needed to
+// represent d exactly.
+func (d Decimal) Scale() int {
+	factors := func(den *big.Int, factor int64) (n int) {
+		f := big.NewInt(factor)
+		q, rem := new(big.Int), new(big.Int)
+		for q.QuoRem(den, f, rem); rem.Sign() == 0; q.QuoRem(den, f, rem) {
+			den.Set(q)
+			n++
+		}
+		return
+	}
+	den := new(big.Int).Set(d.r().Denom())
+	twos := factors(den, 2)
+	fives := factors(den, 5)
+	if twos > fives {
+		return twos
+	}
+	return fives
+}
+
+// Round rounds d to scale digits after the decimal point. Halves are rounded
+// away from zero.
+func (d Decimal) Round(scale int) Decimal {
+	if scale < 0 {
+		scale = 0
+	}
+	m := new(big.Rat).Mul(d.r(), new(big.Rat).SetInt(pow10(scale)))
+	q, rem := new(big.Int).QuoRem(m.Num(), m.Denom(), new(big.Int))
+	if new(big.Int).Lsh(rem.Abs(rem), 1).Cmp(m.Denom()) >= 0 {
+		if m.Sign() < 0 {
+			q.Sub(q, big.NewInt(1))
+		} else {
+			q.Add(q, big.NewInt(1))
+		}
+	}
+	return Decimal{rat: new(big.Rat).SetFrac(q, pow10(scale))}
+}
+
+func (d Decimal) Float64() float64 {
+	f, _ := d.r().Float64()
+	return f
+}
+
+func (d Decimal) String() string {
+	return d.r().FloatString(d.Scale())
+}
+
+// StringFixed returns d rounded to scale digits after the decimal point.
+func (d Decimal) StringFixed(scale int) string {
+	if scale < 0 {
+		scale = 0
+	}
+	return d.Round(scale).r().FloatString(scale)
+}
+
+func (d Decimal) Value() (driver.Value, error) {
+	return d.String(), nil
+}
+
+func (d *Decimal) Scan(value interface{}) (err error) {
+	switch v := value.(type) {
+	case nil:
+		*d = Decimal{}
+	case []byte:
+		*d, err = ParseDecimal(string(v))
+	case string:
+		*d, err = ParseDecimal(v)
+	case int:
+		*d = NewDecimal(int64(v), 0)
+	case int32:
+		*d = NewDecimal(int64(v), 0)
+	case int64:
+		*d = NewDecimal(v, 0)
+	case float32:
+		*d, err = ParseDecimal(strconv.FormatFloat(float64(v), 'f', -1, 32))
+	case float64:
+		*d = DecimalFromFloat(v)
+	case Decimal:
+		*d = v
+	default:
+		err = errors.New(fmt.Sprintf("can't convert '%v' (%T) to Decimal", value, value))
+	}
+	return
+}
+
+// MarshalJSON marshals d as a string, so that JSON clients don't convert it
+// to a floating point number.
+func (d Decimal) MarshalJSON() ([]byte, error) {
+	return []byte(strconv.Quote(d.String())), nil
+}
+
+func (d *Decimal) UnmarshalJSON(data []byte) (err error) {
+	text := string(data)
+	switch {
+	case text == "null":
+		return
+	case strings.HasPrefix(text, "\""):
+		if text, err = strconv.Unquote(text); err != nil {
+			return
+		}
+	}
+	*d, err = ParseDecimal(text)
+	return
+}
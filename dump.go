@@ -0,0 +1,248 @@
+package grumble
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// DumpRecord is the JSON representation of a single entity in a dump. One
+// record is written per line. Parent holds the key chain of the entity's
+// parent, nearest ancestor first, and Values holds the column values keyed
+// by column name.
+type DumpRecord struct {
+	Kind   string                     `json:"kind"`
+	Id     int                        `json:"_id"`
+	Parent []string                   `json:"_parent"`
+	Values map[string]json.RawMessage `json:"values"`
+}
+
+func dumpKinds(kinds []interface{}) (ret []*Kind, err error) {
+	ret = make([]*Kind, 0)
+	seen := make(map[string]bool)
+	add := func(k *Kind) {
+		if !seen[k.Kind] {
+			seen[k.Kind] = true
+			ret = append(ret, k)
+		}
+	}
+	if len(kinds) == 0 {
+		for _, k := range Kinds() {
+			add(k)
+		}
+	}
+	for _, kind := range kinds {
+		k := GetKind(kind)
+		if k == nil {
+			err = errors.New(fmt.Sprintf("cannot dump unknown kind %v", kind))
+			return
+		}
+		add(k)
+		for _, derived := range k.DerivedKinds() {
+			add(derived)
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Kind < ret[j].Kind
+	})
+	return
+}
+
+func makeDumpRecord(e Persistable) (rec DumpRecord, err error) {
+	k := e.Kind()
+	rec.Kind = k.Kind
+	rec.Id = e.Id()
+	rec.Parent = make([]string, 0)
+	for p := e.Parent(); p != nil && !p.IsZero(); p = p.Parent() {
+		rec.Parent = append(rec.Parent, p.String())
+	}
+	rec.Values = make(map[string]json.RawMessage)
+	for _, column := range k.Columns {
+		if column.Formula != "" {
+			continue
+		}
+		var values []interface{}
+		if values, err = column.Converter.Value(e, column); err != nil {
+			return
+		}
+		if len(values) != 1 {
+			err = errors.New(fmt.Sprintf("cannot dump column '%s.%s': converter returned %d values",
+				k.Kind, column.FieldName, len(values)))
+			return
+		}
+		if rec.Values[column.ColumnName], err = json.Marshal(values[0]); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// Dump writes every entity of the given kinds, and of the kinds derived from
+// them, to w as JSON lines. If no kinds are specified all registered kinds are
+// dumped. All kinds are read in one read-only REPEATABLE READ transaction, so
+// the dump is consistent even if the database is written to meanwhile.
+func (mgr *EntityManager) Dump(w io.Writer, kinds ...interface{}) (err error) {
+	dumped, err := dumpKinds(kinds)
+	if err != nil {
+		return
+	}
+	encoder := json.NewEncoder(w)
+	opts := &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true}
+	return mgr.runTransaction(opts, func(tx *sql.Tx) (err error) {
+		for _, k := range dumped {
+			err = mgr.MakeQuery(k).forEach(tx, func(row []Persistable) (err error) {
+				rec, err := makeDumpRecord(row[0])
+				if err != nil {
+					return
+				}
+				return encoder.Encode(rec)
+			})
+			if err != nil {
+				return
+			}
+		}
+		return
+	})
+}
+
+// - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - -
+
+var restoreEntity = SQLTemplate{Name: "RestoreEntity", SQL: `INSERT INTO {{.QualifiedTableName}}
+	( "_id", "_parent"{{if .SingleTable}}, "_kind"{{end}}{{range $i, $c := .Columns}}{{if not .Formula}}, "{{$c.ColumnName}}"{{end}}{{end}} )
+	VALUES
+	( __count__, __count__{{if .SingleTable}}, __count__{{end}}{{range .Columns}}{{if not .Formula}}, {{.Converter.SQLTextOut .}}{{end}}{{end}} )
+`}
+
+var resetSequence = SQLTemplate{Name: "ResetSequence", SQL: `SELECT setval(
+	pg_get_serial_sequence('{{.QualifiedTableName}}', '_id'), COALESCE(MAX("_id"), 0) + 1, false)
+	FROM {{.QualifiedTableName}}
+`}
+
+func restoreValue(column Column, raw json.RawMessage) (ret interface{}, err error) {
+	if converter, ok := column.Converter.(*BasicConverter); ok && converter.GoType != nil {
+		v := reflect.New(converter.GoType)
+		if err = json.Unmarshal(raw, v.Interface()); err != nil {
+			return
+		}
+		ret = v.Elem().Interface()
+		return
+	}
+	if converter, ok := column.Converter.(*ArrayConverter); ok {
+		v := reflect.New(converter.GoType)
+		if err = json.Unmarshal(raw, v.Interface()); err != nil {
+			return
+		}
+		ret = Array{Elements: v.Elem().Interface()}
+		return
+	}
+	if converter, ok := column.Converter.(*PointerConverter); ok {
+		if _, ok = converter.Element.(*BasicConverter); ok {
+			v := reflect.New(converter.GoType)
+			if err = json.Unmarshal(raw, v.Interface()); err != nil {
+				return
+			}
+			if !v.Elem().IsNil() {
+				ret = v.Elem().Elem().Interface()
+			}
+			return
+		}
+	}
+	if _, ok := column.Converter.(*JSONConverter); ok {
+		ret = JSON{Data: raw}
+		return
+	}
+	err = json.Unmarshal(raw, &ret)
+	return
+}
+
+func restore(mgr *EntityManager, rec DumpRecord, conn sqlExecutor) (k *Kind, err error) {
+	k = GetKind(rec.Kind)
+	if k == nil {
+		err = errors.New(fmt.Sprintf("cannot restore entity of unknown kind '%s'", rec.Kind))
+		return
+	}
+	if rec.Id <= 0 {
+		err = errors.New(fmt.Sprintf("cannot restore entity of kind '%s' without _id", rec.Kind))
+		return
+	}
+	parent, err := ParseKey(strings.Join(rec.Parent, ","))
+	if err != nil {
+		return
+	}
+	e, err := mgr.Make(k, parent, rec.Id)
+	if err != nil {
+		return
+	}
+	values := []interface{}{rec.Id, parent.Chain()}
+	if k.SingleTable {
+		values = append(values, k.Kind)
+	}
+	for _, column := range k.Columns {
+		if column.Formula != "" {
+			continue
+		}
+		if raw, ok := rec.Values[column.ColumnName]; ok {
+			var value interface{}
+			if value, err = restoreValue(column, raw); err != nil {
+				return
+			}
+			values = append(values, value)
+		} else {
+			var columnValues []interface{}
+			if columnValues, err = column.Converter.Value(e, column); err != nil {
+				return
+			}
+			values = append(values, columnValues...)
+		}
+	}
+	sqlText, err := restoreEntity.Process(k)
+	if err != nil {
+		return
+	}
+	_, err = conn.Exec(sqlText, values...)
+	return
+}
+
+// Restore reads entities written by Dump from r and inserts them with their
+// original ids and parent chains. The serial sequences of all restored kinds
+// are reset afterwards. Everything happens in a single transaction, which is
+// rolled back if any entity fails to restore.
+func (mgr *EntityManager) Restore(r io.Reader) (err error) {
+	return mgr.Transaction(func(tx *sql.Tx) error {
+		return mgr.RestoreTx(tx, r)
+	})
+}
+
+// RestoreTx is Restore as part of the transaction tx of the caller.
+func (mgr *EntityManager) RestoreTx(tx *sql.Tx, r io.Reader) (err error) {
+	restored := make(map[string]*Kind)
+	decoder := json.NewDecoder(r)
+	for {
+		var rec DumpRecord
+		if err = decoder.Decode(&rec); err == io.EOF {
+			break
+		} else if err != nil {
+			return
+		}
+		var k *Kind
+		if k, err = restore(mgr, rec, tx); err != nil {
+			return
+		}
+		restored[k.Kind] = k
+	}
+	for _, k := range restored {
+		var sqlText string
+		if sqlText, err = resetSequence.Process(k); err != nil {
+			return
+		}
+		if _, err = tx.Exec(sqlText); err != nil {
+			return
+		}
+	}
+	return nil
+}
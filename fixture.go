@@ -0,0 +1,199 @@
+package grumble
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// Fixture describes a single entity to be created by LoadFixtures. Fields
+// maps field names to literal values. Parent and the values of Refs are the
+// symbolic names of other fixtures, which are persisted first.
+type Fixture struct {
+	Name   string                 `json:"name" yaml:"name"`
+	Kind   string                 `json:"kind" yaml:"kind"`
+	Parent string                 `json:"parent" yaml:"parent"`
+	Fields map[string]interface{} `json:"fields" yaml:"fields"`
+	Refs   map[string]string      `json:"refs" yaml:"refs"`
+}
+
+// unmarshalFixtures decodes a list of fixtures. Only JSON is supported,
+// unless the package is built with the yaml tag, which replaces it with a
+// YAML decoder from gopkg.in/yaml.v3. YAML is a superset of JSON, so JSON
+// fixtures load either way.
+var unmarshalFixtures = json.Unmarshal
+
+func (fixture Fixture) dependencies() (ret []string) {
+	ret = make([]string, 0)
+	if fixture.Parent != "" {
+		ret = append(ret, fixture.Parent)
+	}
+	for _, ref := range fixture.Refs {
+		ret = append(ret, ref)
+	}
+	return
+}
+
+func (fixture Fixture) String() string {
+	if fixture.Name != "" {
+		return fmt.Sprintf("%q", fixture.Name)
+	}
+	return fmt.Sprintf("<anonymous %s>", fixture.Kind)
+}
+
+func orderFixtures(fixtures []Fixture) (ret []Fixture, err error) {
+	byName := make(map[string]int)
+	for ix, fixture := range fixtures {
+		if fixture.Name == "" {
+			continue
+		}
+		if _, ok := byName[fixture.Name]; ok {
+			err = errors.New(fmt.Sprintf("duplicate fixture name %q", fixture.Name))
+			return
+		}
+		byName[fixture.Name] = ix
+	}
+
+	const (
+		todo = iota
+		visiting
+		done
+	)
+	state := make([]int, len(fixtures))
+	ret = make([]Fixture, 0, len(fixtures))
+	var visit func(ix int) error
+	visit = func(ix int) error {
+		switch state[ix] {
+		case done:
+			return nil
+		case visiting:
+			return errors.New(fmt.Sprintf("fixture %s is part of a dependency cycle", fixtures[ix]))
+		}
+		state[ix] = visiting
+		for _, dep := range fixtures[ix].dependencies() {
+			depIx, ok := byName[dep]
+			if !ok {
+				return errors.New(fmt.Sprintf("fixture %s refers to unknown fixture %q", fixtures[ix], dep))
+			}
+			if err := visit(depIx); err != nil {
+				return err
+			}
+		}
+		state[ix] = done
+		ret = append(ret, fixtures[ix])
+		return nil
+	}
+	for ix := range fixtures {
+		if err = visit(ix); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func setFixtureField(e Persistable, field string, value interface{}) (err error) {
+	column, ok := e.Kind().Column(field)
+	if nested, isMap := value.(map[string]interface{}); !ok && isMap {
+		for name, v := range nested {
+			if err = setFixtureField(e, field+"."+name, v); err != nil {
+				return
+			}
+		}
+		return
+	}
+	if !ok {
+		return errors.New(fmt.Sprintf("kind '%s' has no field %q", e.Kind().Kind, field))
+	}
+	if setter, ok := column.Converter.(Setter); ok {
+		return setter.SetValue(e, column, value)
+	}
+	if !SetField(e, field, value) {
+		err = errors.New(fmt.Sprintf("could not set field %q on entity of kind '%s'", field, e.Kind().Kind))
+	}
+	return
+}
+
+func (mgr *EntityManager) putFixture(fixture Fixture, named map[string]Persistable) (e Persistable, err error) {
+	k := GetKind(fixture.Kind)
+	if k == nil {
+		err = errors.New(fmt.Sprintf("fixture %s has unknown kind %q", fixture, fixture.Kind))
+		return
+	}
+	parent := ZeroKey
+	if fixture.Parent != "" {
+		parent = named[fixture.Parent].AsKey()
+	}
+	if e, err = mgr.New(k, parent); err != nil {
+		return
+	}
+	for field, value := range fixture.Fields {
+		if err = setFixtureField(e, field, value); err != nil {
+			return
+		}
+	}
+	for field, ref := range fixture.Refs {
+		if err = setFixtureField(e, field, named[ref]); err != nil {
+			return
+		}
+	}
+	err = mgr.Put(e)
+	return
+}
+
+// LoadFixtures creates the entities described by the given fixtures. The
+// fixtures are persisted in dependency order, so that parents and referenced
+// entities exist before the entities pointing to them. The persisted
+// entities are returned keyed by fixture name.
+func (mgr *EntityManager) LoadFixtures(fixtures []Fixture) (ret map[string]Persistable, err error) {
+	ordered, err := orderFixtures(fixtures)
+	if err != nil {
+		return
+	}
+	ret = make(map[string]Persistable)
+	err = mgr.TX(func(db *sql.DB) (err error) {
+		for _, fixture := range ordered {
+			var e Persistable
+			if e, err = mgr.putFixture(fixture, ret); err != nil {
+				return
+			}
+			if fixture.Name != "" {
+				ret[fixture.Name] = e
+			}
+		}
+		return
+	})
+	return
+}
+
+// ReadFixtures decodes a list of fixtures in JSON format, or YAML if built
+// with the yaml tag, from r.
+func ReadFixtures(r io.Reader) (fixtures []Fixture, err error) {
+	text, err := ioutil.ReadAll(r)
+	if err != nil {
+		return
+	}
+	err = unmarshalFixtures(text, &fixtures)
+	return
+}
+
+// LoadFixtureFiles reads the fixtures from all given JSON (or YAML) files and
+// loads them as one set, so fixtures can refer to fixtures in other files.
+func (mgr *EntityManager) LoadFixtureFiles(fileNames ...string) (ret map[string]Persistable, err error) {
+	fixtures := make([]Fixture, 0)
+	for _, fileName := range fileNames {
+		var text []byte
+		if text, err = ioutil.ReadFile(fileName); err != nil {
+			return
+		}
+		var fromFile []Fixture
+		if err = unmarshalFixtures(text, &fromFile); err != nil {
+			err = errors.New(fmt.Sprintf("fixture file %q: %s", fileName, err))
+			return
+		}
+		fixtures = append(fixtures, fromFile...)
+	}
+	return mgr.LoadFixtures(fixtures)
+}
@@ -0,0 +1,11 @@
+//go:build yaml
+// +build yaml
+
+package grumble
+
+import "gopkg.in/yaml.v3"
+
+// Building with the yaml tag requires gopkg.in/yaml.v3.
+func init() {
+	unmarshalFixtures = yaml.Unmarshal
+}
@@ -1,10 +1,20 @@
 package grumble
 
 import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"math"
+	"net"
+	"net/url"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/google/uuid"
 )
 
 const ProductKind = "github.com.jandevisser.grumble.product"
@@ -48,6 +58,53 @@ func TestMakeEntityManager(t *testing.T) {
 	}
 }
 
+func TestRegister(t *testing.T) {
+	registerKinds(t, &Department{}, &Product{}, &Fruit{}, &Sale{}, &SelfRef{})
+}
+
+// registerKinds registers the types a test uses and reconciles their
+// tables, so that every test only depends on the Kinds it declares itself.
+func registerKinds(t *testing.T, types ...interface{}) {
+	t.Helper()
+	if err := Register(types...); err != nil {
+		t.Fatal(err)
+	}
+	if err := ReconcileAll(mgr.PostgreSQLAdapter); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// freshManager returns an EntityManager with an empty cache, so that
+// entities are read back from the database.
+func freshManager(t *testing.T) *EntityManager {
+	t.Helper()
+	ret, err := MakeEntityManager()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ret
+}
+
+type Unregistered struct {
+	Key
+	Name string
+}
+
+func TestGetKind_Unregistered(t *testing.T) {
+	if err := Register(nil); err == nil {
+		t.Fatal("Registering nil did not fail")
+	}
+	if k := GetKind(&Unregistered{}); k != nil {
+		t.Fatalf("Unregistered type was registered implicitly as '%s'", k.Kind)
+	}
+	if _, err := mgr.New(&Unregistered{}, nil); err == nil {
+		t.Fatal("Could create entity of unregistered type")
+	}
+	if err := mgr.Put(&Unregistered{Name: "Foo"}); err == nil {
+		t.Fatal("Could persist entity of unregistered type")
+	}
+}
+
 func CreateDepartment(parent *Department, name string, description string) (department *Department, err error) {
 	var p *Key
 	if parent != nil {
@@ -203,6 +260,54 @@ func TestCreateKey(t *testing.T) {
 	}
 }
 
+func TestEncodeKey(t *testing.T) {
+	parent, _ := CreateKey(nil, GetKind(&Department{}), 3)
+	key, _ := CreateKey(parent, GetKind(ProductKind), SampleId)
+	encoded := key.Encode()
+	if strings.ContainsAny(encoded, "+/=(),\"") {
+		t.Fatalf("Encoded key %q is not URL-safe", encoded)
+	}
+	decoded, err := DecodeKey(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Chain() != key.Chain() {
+		t.Fatalf("Decoded key %s != %s", decoded.Chain(), key.Chain())
+	}
+	if parsed, err := ParseKey(encoded); err != nil || parsed.Chain() != key.Chain() {
+		t.Fatalf("ParseKey(%q) = %v, %v", encoded, parsed, err)
+	}
+	if id, err := ParseId(GetKind(ProductKind), encoded); err != nil || id != SampleId {
+		t.Fatalf("ParseId(%q) = %d, %v", encoded, id, err)
+	}
+	if _, err := ParseId(GetKind(&Department{}), encoded); err == nil {
+		t.Fatal("ParseId accepted the key of another kind")
+	}
+	jsonText, err := json.Marshal(map[string]EncodedKey{"key": {key}, "zero": {ZeroKey}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var unmarshalled map[string]EncodedKey
+	if err = json.Unmarshal(jsonText, &unmarshalled); err != nil {
+		t.Fatal(err)
+	}
+	if unmarshalled["key"].Chain() != key.Chain() || !unmarshalled["zero"].IsZero() {
+		t.Fatalf("Keys not unmarshalled from %s: %v", jsonText, unmarshalled)
+	}
+
+	// With two Kinds named department, keys are encoded with the full name.
+	type department struct{ Key }
+	typ := reflect.TypeOf(department{})
+	RegistryByType[typ] = &Kind{Kind: "example.com.other.department"}
+	defer delete(RegistryByType, typ)
+	if GetKind("department") != nil {
+		t.Fatal("Ambiguous basename resolved to a kind")
+	}
+	if decoded, err = DecodeKey(parent.Encode()); err != nil || decoded.Kind() != parent.Kind() {
+		t.Fatalf("Key with ambiguous basename decoded as %v, %v", decoded, err)
+	}
+}
+
 func TestEntity_SetKind(t *testing.T) {
 	product := Product{}
 	SetKind(&product)
@@ -702,3 +807,1458 @@ func TestQuery_Computed(t *testing.T) {
 		}
 	}
 }
+
+func TestDumpRestore(t *testing.T) {
+	var buf bytes.Buffer
+	if err := mgr.Dump(&buf, &Department{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := GetKind(&Department{}).Truncate(mgr.PostgreSQLAdapter); err != nil {
+		t.Fatal(err)
+	}
+	restoreMgr, err := MakeEntityManager()
+	if err != nil {
+		t.Fatal(err)
+	}
+	broken := bytes.NewBuffer(append(append([]byte{}, buf.Bytes()...), []byte(`{"kind":"nosuchkind","_id":1}`+"\n")...))
+	if err = restoreMgr.Restore(broken); err == nil {
+		t.Fatal("Restoring an unknown kind did not fail")
+	}
+	if e, err := restoreMgr.Get(&Department{}, GroceriesID); err != nil || e != nil {
+		t.Fatalf("Failed restore was not rolled back: %v, %v", e, err)
+	}
+	if err = restoreMgr.Restore(&buf); err != nil {
+		t.Fatal(err)
+	}
+	e, err := restoreMgr.Get(&Department{}, GroceriesID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e == nil || e.(*Department).Name != "Groceries" {
+		t.Fatalf("Department %d not restored", GroceriesID)
+	}
+	q := restoreMgr.MakeQuery(&Department{})
+	q.HasParent(e)
+	results, err := q.Execute()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 {
+		t.Fatalf("Expected 1 child department, got %d", len(results))
+	}
+	added, err := CreateDepartment(nil, "Bakery", "Bread and Pastries")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if added.Id() <= results[0][0].Id() {
+		t.Fatalf("Sequence not reset after restore: new id %d", added.Id())
+	}
+}
+
+func TestLoadFixtureFiles(t *testing.T) {
+	entities, err := mgr.LoadFixtureFiles("testdata/fixtures.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entities) != 4 {
+		t.Fatalf("Expected 4 fixtures, got %d", len(entities))
+	}
+	tools := entities["tools"].(*Department)
+	if tools.Parent().Id() != entities["hardware"].Id() {
+		t.Fatalf("Fixture 'tools' does not have 'hardware' as parent")
+	}
+	e, err := mgr.Get(&Sale{}, entities["hammersale"].Id())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sale := e.(*Sale)
+	if sale.Quantity != 2 || sale.Product.Name != "Hammer" {
+		t.Fatalf("Fixture 'hammersale' not loaded properly: %d %q", sale.Quantity, sale.Product.Name)
+	}
+}
+
+type Recipe struct {
+	Key
+	Name     string
+	Tags     []string
+	Servings []int
+	Ratings  []float64
+	Tested   []bool
+	Cooked   []time.Time
+}
+
+func TestPut_Arrays(t *testing.T) {
+	registerKinds(t, &Recipe{})
+	cooked := time.Date(2020, 3, 14, 18, 30, 0, 0, time.UTC)
+	recipe := &Recipe{
+		Name:     "Ratatouille",
+		Tags:     []string{"french", "vegetarian", "stew"},
+		Servings: []int{2, 4},
+		Ratings:  []float64{4.5, 3.75},
+		Tested:   []bool{true, false},
+		Cooked:   []time.Time{cooked},
+	}
+	if err := mgr.Put(recipe); err != nil {
+		t.Fatal(err)
+	}
+	if err := mgr.Put(&Recipe{Name: "Toast"}); err != nil {
+		t.Fatal(err)
+	}
+	getMgr := freshManager(t)
+	e, err := getMgr.Get(&Recipe{}, recipe.Id())
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := e.(*Recipe)
+	if !reflect.DeepEqual(got.Tags, recipe.Tags) || !reflect.DeepEqual(got.Servings, recipe.Servings) ||
+		!reflect.DeepEqual(got.Ratings, recipe.Ratings) || !reflect.DeepEqual(got.Tested, recipe.Tested) {
+		t.Fatalf("ARRAY columns not round-tripped: %v %v %v %v", got.Tags, got.Servings, got.Ratings, got.Tested)
+	}
+	if len(got.Cooked) != 1 || !got.Cooked[0].Equal(cooked) {
+		t.Fatalf("Timestamp ARRAY column not round-tripped: %v", got.Cooked)
+	}
+
+	q := mgr.MakeQuery(&Recipe{})
+	q.AddCondition(&ArrayContains{Column: "Tags", Elements: []string{"stew", "french"}})
+	q.AddCondition(&ArrayOverlaps{Column: "Servings", Elements: []int{1, 2}})
+	q.AddCondition(&ArrayAnyEquals{Column: "Tested", Value: true})
+	results, err := q.Execute()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0][0].Id() != recipe.Id() {
+		t.Fatalf("Expected recipe %d, got %d results", recipe.Id(), len(results))
+	}
+
+	results, err = mgr.Query(&Recipe{}, url.Values{"Tags": {"vegan,stew"}, "_array": {"overlaps"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0][0].Id() != recipe.Id() {
+		t.Fatalf("Expected recipe %d, got %d results", recipe.Id(), len(results))
+	}
+}
+
+func TestReconcile_Arrays(t *testing.T) {
+	registerKinds(t, &Recipe{})
+	recipe := &Recipe{Name: "Ratatouille", Tags: []string{"vegan", "french"}, Cooked: []time.Time{time.Date(2021, 7, 14, 18, 0, 0, 0, time.UTC)}}
+	if err := mgr.Put(recipe); err != nil {
+		t.Fatal(err)
+	}
+	k := GetKind(&Recipe{})
+	// Spell the types differently than the converters do.
+	for _, s := range []string{
+		fmt.Sprintf("ALTER TABLE %s ALTER COLUMN \"Tags\" TYPE character varying[]", k.QualifiedTableName()),
+		fmt.Sprintf("ALTER TABLE %s ALTER COLUMN \"Cooked\" TYPE timestamp[]", k.QualifiedTableName()),
+	} {
+		if _, err := mgr.PostgreSQLAdapter.GetConnection().Exec(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for pass := 0; pass < 2; pass++ {
+		if err := k.Reconcile(mgr.PostgreSQLAdapter); err != nil {
+			t.Fatal(err)
+		}
+	}
+	e, err := freshManager(t).Get(&Recipe{}, recipe.Id())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := e.(*Recipe); len(got.Tags) != 2 || got.Tags[1] != "french" || len(got.Cooked) != 1 {
+		t.Fatalf("ARRAY columns lost by Reconcile: %v %v", got.Tags, got.Cooked)
+	}
+}
+
+type Preferences struct {
+	Theme string   `json:"theme"`
+	Fonts []string `json:"fonts"`
+}
+
+type Device struct {
+	Name string `json:"name"`
+	OS   string `json:"os"`
+}
+
+type Profile struct {
+	Key
+	Name        string
+	Settings    map[string]interface{} `grumble:"index=gin"`
+	Preferences Preferences            `grumble:"json"`
+	Devices     []Device
+}
+
+func TestPut_JSON(t *testing.T) {
+	registerKinds(t, &Profile{})
+	profile := &Profile{
+		Name:        "jan",
+		Settings:    map[string]interface{}{"editor": map[string]interface{}{"tabs": 4.0, "wrap": true}},
+		Preferences: Preferences{Theme: "dark", Fonts: []string{"Menlo", "Monaco"}},
+		Devices:     []Device{{Name: "laptop", OS: "macOS"}, {Name: "phone", OS: "Android"}},
+	}
+	if err := mgr.Put(profile); err != nil {
+		t.Fatal(err)
+	}
+	if err := mgr.Put(&Profile{Name: "empty"}); err != nil {
+		t.Fatal(err)
+	}
+	getMgr := freshManager(t)
+	e, err := getMgr.Get(&Profile{}, profile.Id())
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := e.(*Profile)
+	if !reflect.DeepEqual(got.Settings, profile.Settings) || !reflect.DeepEqual(got.Preferences, profile.Preferences) ||
+		!reflect.DeepEqual(got.Devices, profile.Devices) {
+		t.Fatalf("jsonb columns not round-tripped: %v %v %v", got.Settings, got.Preferences, got.Devices)
+	}
+
+	q := mgr.MakeQuery(&Profile{})
+	q.AddCondition(&JSONContains{Column: "Devices", Value: []map[string]string{{"os": "Android"}}})
+	q.AddCondition(&JSONContains{Column: "Settings", Path: []string{"editor"}, Value: map[string]int{"tabs": 4}})
+	q.AddCondition(&JSONHasKey{Column: "Preferences", Key: "theme"})
+	results, err := q.Execute()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0][0].Id() != profile.Id() {
+		t.Fatalf("Expected profile %d, got %d results", profile.Id(), len(results))
+	}
+}
+
+type TaskStatus string
+
+func (s TaskStatus) EnumValues() []string {
+	return []string{"open", "active", "done"}
+}
+
+type Priority int
+
+func (p Priority) EnumValues() []string {
+	return []string{"low", "normal", "high"}
+}
+
+type Task struct {
+	Key
+	Name     string
+	Status   TaskStatus
+	Priority Priority
+}
+
+func TestPut_Enum(t *testing.T) {
+	registerKinds(t, &Task{})
+	task := &Task{Name: "Write tests", Status: "active", Priority: 2}
+	if err := mgr.Put(task); err != nil {
+		t.Fatal(err)
+	}
+	getMgr := freshManager(t)
+	e, err := getMgr.Get(&Task{}, task.Id())
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := e.(*Task)
+	if got.Status != "active" || got.Priority != 2 {
+		t.Fatalf("ENUM columns not round-tripped: %q %d", got.Status, got.Priority)
+	}
+	if err = mgr.Put(&Task{Name: "Bogus", Status: "someday"}); err == nil {
+		t.Fatalf("Put accepted invalid TaskStatus value")
+	}
+	if err = mgr.Put(&Task{Name: "Bogus", Status: "open", Priority: 3}); err == nil {
+		t.Fatalf("Put accepted invalid Priority value")
+	}
+}
+
+func TestReconcile_Enum(t *testing.T) {
+	registerKinds(t, &Task{})
+	task := &Task{Name: "Reconcile", Status: "done", Priority: 1}
+	if err := mgr.Put(task); err != nil {
+		t.Fatal(err)
+	}
+	k := GetKind(&Task{})
+	for pass := 0; pass < 2; pass++ {
+		if err := k.Reconcile(mgr.PostgreSQLAdapter); err != nil {
+			t.Fatal(err)
+		}
+	}
+	e, err := freshManager(t).Get(&Task{}, task.Id())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := e.(*Task); got.Status != "done" || got.Priority != 1 {
+		t.Fatalf("ENUM columns lost by Reconcile: %q %d", got.Status, got.Priority)
+	}
+}
+
+type Address struct {
+	Street string
+	City   string
+	Zip    string
+}
+
+type Store struct {
+	Key
+	Name     string
+	Address  Address
+	Shipping Address `grumble:"prefix=ship_"`
+}
+
+func TestPut_ValueStruct(t *testing.T) {
+	registerKinds(t, &Store{})
+	kind := GetKind(&Store{})
+	if col, ok := kind.Column("Shipping.City"); !ok || col.ColumnName != "ship_City" {
+		t.Fatalf("Value struct field not flattened into prefixed column: %v", kind.ColumnNames())
+	}
+	store := &Store{
+		Name:     "Downtown",
+		Address:  Address{Street: "1 Main St", City: "Springfield", Zip: "12345"},
+		Shipping: Address{Street: "2 Dock Rd", City: "Shelbyville", Zip: "54321"},
+	}
+	if err := mgr.Put(store); err != nil {
+		t.Fatal(err)
+	}
+	if err := mgr.Put(&Store{Name: "Uptown", Address: Address{City: "Capital City"}}); err != nil {
+		t.Fatal(err)
+	}
+	getMgr := freshManager(t)
+	e, err := getMgr.Get(&Store{}, store.Id())
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := e.(*Store)
+	if got.Address != store.Address || got.Shipping != store.Shipping {
+		t.Fatalf("Value structs not rebuilt: %v %v", got.Address, got.Shipping)
+	}
+	q := mgr.MakeQuery(&Store{})
+	q.AddFilter("Address.City", "Springfield")
+	q.AddSort(Sort{Column: "Address.Zip"})
+	results, err := q.Execute()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0][0].Id() != store.Id() {
+		t.Fatalf("Expected store %d, got %d results", store.Id(), len(results))
+	}
+}
+
+type Shipment struct {
+	Key
+	Reference string
+	Weight    *float64
+	Boxes     *int
+	Shipped   *time.Time
+	Priority  *Priority
+	Carrier   sql.NullString
+}
+
+func TestPut_Nullable(t *testing.T) {
+	registerKinds(t, &Shipment{})
+	shipped := time.Date(2020, 6, 1, 9, 0, 0, 0, time.UTC)
+	boxes := 3
+	priority := Priority(1)
+	sent := &Shipment{
+		Reference: "sent",
+		Boxes:     &boxes,
+		Shipped:   &shipped,
+		Priority:  &priority,
+		Carrier:   sql.NullString{String: "UPS", Valid: true},
+	}
+	if err := mgr.Put(sent); err != nil {
+		t.Fatal(err)
+	}
+	pending := &Shipment{Reference: "pending"}
+	if err := mgr.Put(pending); err != nil {
+		t.Fatal(err)
+	}
+	getMgr := freshManager(t)
+	e, err := getMgr.Get(&Shipment{}, sent.Id())
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := e.(*Shipment)
+	if got.Weight != nil || got.Boxes == nil || *got.Boxes != 3 || got.Shipped == nil || !got.Shipped.Equal(shipped) ||
+		got.Priority == nil || *got.Priority != 1 || got.Carrier.String != "UPS" {
+		t.Fatalf("Nullable columns not round-tripped: %v %v %v %v %v", got.Weight, got.Boxes, got.Shipped, got.Priority, got.Carrier)
+	}
+	e, err = getMgr.Get(&Shipment{}, pending.Id())
+	if err != nil {
+		t.Fatal(err)
+	}
+	got = e.(*Shipment)
+	if got.Boxes != nil || got.Shipped != nil || got.Priority != nil || got.Carrier.Valid {
+		t.Fatalf("NULL columns not scanned as nil: %v %v %v %v", got.Boxes, got.Shipped, got.Priority, got.Carrier)
+	}
+	q := mgr.MakeQuery(&Shipment{})
+	q.AddFilter("Shipped", nil)
+	results, err := q.Execute()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0][0].Id() != pending.Id() {
+		t.Fatalf("Expected shipment %d, got %d results", pending.Id(), len(results))
+	}
+	results, err = mgr.Query(&Shipment{}, url.Values{"_notnull": {"Carrier"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0][0].Id() != sent.Id() {
+		t.Fatalf("Expected shipment %d, got %d results", sent.Id(), len(results))
+	}
+}
+
+type Account struct {
+	Key
+	Name    string
+	Balance Decimal `grumble:"transient"`
+}
+
+type Invoice struct {
+	Key
+	Account *Account
+	Amount  Decimal `grumble:"precision=12;scale=2"`
+}
+
+func TestPut_Decimal(t *testing.T) {
+	registerKinds(t, &Account{}, &Invoice{})
+	account := &Account{Name: "Acme"}
+	if err := mgr.Put(account); err != nil {
+		t.Fatal(err)
+	}
+	amounts := []string{"0.10", "0.20", "1234567890.05"}
+	total := Decimal{}
+	var first *Invoice
+	for _, a := range amounts {
+		amount, err := ParseDecimal(a)
+		if err != nil {
+			t.Fatal(err)
+		}
+		total = total.Add(amount)
+		invoice := &Invoice{Account: account, Amount: amount}
+		if err := mgr.Put(invoice); err != nil {
+			t.Fatal(err)
+		}
+		if first == nil {
+			first = invoice
+		}
+	}
+	getMgr := freshManager(t)
+	e, err := getMgr.Get(&Invoice{}, first.Id())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := e.(*Invoice); got.Amount.String() != "0.1" {
+		t.Fatalf("Decimal not round-tripped: %s", got.Amount)
+	}
+
+	q := mgr.MakeQuery(&Account{})
+	q.AddFilter("Name", "Acme")
+	join := Join{QueryTable: QueryTable{Kind: GetKind(&Invoice{})}, FieldName: "Account", Direction: ReferredBy}
+	join.AddAggregate(Aggregate{
+		Function: "SUM",
+		Column:   "Amount",
+		Name:     "Balance",
+		Default:  "0",
+	})
+	q.AddJoin(join)
+	q.GroupBy = true
+	results, err := q.Execute()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 {
+		t.Fatalf("Expected 1 result, got %d", len(results))
+	}
+	if balance := results[0][0].(*Account).Balance; !balance.Equal(total) {
+		t.Fatalf("Aggregated Decimal lost precision: %s != %s", balance, total)
+	}
+}
+
+type Session struct {
+	Key
+	Token    uuid.UUID
+	Started  time.Time `grumble:"tz"`
+	Timeout  time.Duration
+	ClientIP net.IP
+	Network  net.IPNet
+}
+
+func TestPut_ExtendedScalars(t *testing.T) {
+	registerKinds(t, &Session{})
+	started := time.Date(2020, 6, 1, 9, 30, 0, 0, time.FixedZone("EDT", -4*3600))
+	_, network, _ := net.ParseCIDR("10.1.0.0/16")
+	session := &Session{
+		Token:    uuid.New(),
+		Started:  started,
+		Timeout:  26*time.Hour + 90*time.Minute + 500*time.Millisecond,
+		ClientIP: net.ParseIP("10.1.2.3"),
+		Network:  *network,
+	}
+	if err := mgr.Put(session); err != nil {
+		t.Fatal(err)
+	}
+	anonymous := &Session{}
+	if err := mgr.Put(anonymous); err != nil {
+		t.Fatal(err)
+	}
+	getMgr := freshManager(t)
+	e, err := getMgr.Get(&Session{}, session.Id())
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := e.(*Session)
+	if got.Token != session.Token || !got.Started.Equal(started) || got.Timeout != session.Timeout ||
+		!got.ClientIP.Equal(session.ClientIP) || got.Network.String() != "10.1.0.0/16" {
+		t.Fatalf("Extended scalars not round-tripped: %v %v %v %v %v",
+			got.Token, got.Started, got.Timeout, got.ClientIP, got.Network.String())
+	}
+	e, err = getMgr.Get(&Session{}, anonymous.Id())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got = e.(*Session); got.ClientIP != nil {
+		t.Fatalf("Empty IP not stored as NULL: %v", got.ClientIP)
+	}
+	k := GetKind(&Session{})
+	col, _ := k.Column("Timeout")
+	if err := col.Converter.(Setter).SetValue(got, col, "1h30m"); err != nil || got.Timeout != 90*time.Minute {
+		t.Fatalf("Could not parse Duration form input: %v %v", got.Timeout, err)
+	}
+	col, _ = k.Column("ClientIP")
+	if err := col.Converter.(Setter).SetValue(got, col, "::1"); err != nil || !got.ClientIP.Equal(net.IPv6loopback) {
+		t.Fatalf("Could not parse IP form input: %v %v", got.ClientIP, err)
+	}
+}
+
+type Counter struct {
+	Key   `grumble:"bigserial"`
+	Small uint8
+	Hits  uint32
+	Total uint64
+	Big   int64
+}
+
+func TestPut_Integers(t *testing.T) {
+	registerKinds(t, &Counter{}, &Tally{})
+	counter := &Counter{
+		Small: math.MaxUint8,
+		Hits:  math.MaxUint32,
+		Total: math.MaxUint64,
+		Big:   math.MaxInt64,
+	}
+	if err := mgr.Put(counter); err != nil {
+		t.Fatal(err)
+	}
+	getMgr := freshManager(t)
+	e, err := getMgr.Get(&Counter{}, counter.Id())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := e.(*Counter); got.Small != counter.Small || got.Hits != counter.Hits || got.Total != counter.Total || got.Big != counter.Big {
+		t.Fatalf("Integers not round-tripped: %d %d %d %d", got.Small, got.Hits, got.Total, got.Big)
+	}
+	k := GetKind(&Counter{})
+	col, _ := k.Column("Small")
+	if err := col.Converter.(Setter).SetValue(counter, col, "256"); err == nil {
+		t.Fatalf("Could assign 256 to uint8 field")
+	}
+	col, _ = k.Column("Big")
+	if err := col.Converter.(Setter).SetValue(counter, col, "9000000000"); err != nil || counter.Big != 9000000000 {
+		t.Fatalf("Could not parse int64 form input: %d %v", counter.Big, err)
+	}
+
+	if _, err = mgr.GetConnection().Exec("SELECT setval(pg_get_serial_sequence($1, '_id'), $2)",
+		k.QualifiedTableName(), int64(math.MaxInt32)+10); err != nil {
+		t.Fatal(err)
+	}
+	big := &Counter{}
+	if err = mgr.Put(big); err != nil {
+		t.Fatal(err)
+	}
+	if big.Id() <= math.MaxInt32 {
+		t.Fatalf("Expected an id above 2^31-1, got %d", big.Id())
+	}
+	e, err = mgr.New(&Tally{}, big.AsKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.(*Tally).Counter = big
+	if err = mgr.Put(e); err != nil {
+		t.Fatal(err)
+	}
+	getMgr = freshManager(t)
+	if e, err = getMgr.Get(&Tally{}, e.Id()); err != nil {
+		t.Fatal(err)
+	}
+	if tally := e.(*Tally); tally.Parent().Id() != big.Id() || tally.Counter == nil || tally.Counter.Id() != big.Id() {
+		t.Fatalf("References to id %d not round-tripped: %v %v", big.Id(), tally.Parent(), tally.Counter)
+	}
+}
+
+func TestReconcile_Narrowing(t *testing.T) {
+	registerKinds(t, &Counter{})
+	counter := &Counter{Small: 7, Hits: math.MaxUint32}
+	if err := mgr.Put(counter); err != nil {
+		t.Fatal(err)
+	}
+	k := GetKind(&Counter{})
+	// Columns created wider than their converters declare are kept.
+	for _, s := range []string{
+		fmt.Sprintf("ALTER TABLE %s ALTER COLUMN \"Small\" TYPE bigint", k.QualifiedTableName()),
+		fmt.Sprintf("ALTER TABLE %s ALTER COLUMN \"Hits\" TYPE numeric(20,0)", k.QualifiedTableName()),
+	} {
+		if _, err := mgr.PostgreSQLAdapter.GetConnection().Exec(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := k.Reconcile(mgr.PostgreSQLAdapter); err != nil {
+		t.Fatal(err)
+	}
+	e, err := freshManager(t).Get(&Counter{}, counter.Id())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := e.(*Counter); got.Small != 7 || got.Hits != math.MaxUint32 {
+		t.Fatalf("Integer columns lost by Reconcile: %d %d", got.Small, got.Hits)
+	}
+}
+
+type Tally struct {
+	Key
+	Counter *Counter
+}
+
+type Member struct {
+	Key
+	Handle   string `grumble:"required;minlen=3;maxlen=12;pattern=[a-z][a-z0-9_]*"`
+	Age      int    `grumble:"min=13;max=130"`
+	Level    string `grumble:"oneof=bronze,silver,gold"`
+	Email    string
+	Nickname *string `grumble:"maxlen=8"`
+}
+
+func (m *Member) Validate() error {
+	if m.Level == "gold" && m.Email == "" {
+		return ValidationErrors{"Email": {"is required for gold members"}}
+	}
+	return nil
+}
+
+func TestPut_Validation(t *testing.T) {
+	registerKinds(t, &Member{})
+	nickname := "much too long"
+	member := &Member{Handle: "X!", Age: 7, Level: "platinum", Nickname: &nickname}
+	err := mgr.Put(member)
+	errs, ok := err.(ValidationErrors)
+	if !ok {
+		t.Fatalf("Expected ValidationErrors, got %v", err)
+	}
+	for _, field := range []string{"Handle", "Age", "Level", "Nickname"} {
+		if len(errs[field]) == 0 {
+			t.Errorf("No validation error for %s: %v", field, errs)
+		}
+	}
+	if len(errs["Handle"]) != 2 {
+		t.Errorf("Expected minlen and pattern errors for Handle, got %v", errs["Handle"])
+	}
+	if member.Id() != 0 {
+		t.Fatalf("Invalid entity was stored as %d", member.Id())
+	}
+	if err = mgr.Put(&Member{Age: 20}); err == nil || len(err.(ValidationErrors)["Handle"]) != 1 {
+		t.Fatalf("Required field not enforced: %v", err)
+	}
+	member = &Member{Handle: "jdoe", Age: 30, Level: "gold"}
+	if err = mgr.Put(member); err == nil || len(err.(ValidationErrors)["Email"]) != 1 {
+		t.Fatalf("Validate() not called: %v", err)
+	}
+	member.Email = "jdoe@example.com"
+	if err = mgr.Put(member); err != nil {
+		t.Fatal(err)
+	}
+}
+
+type Sku struct {
+	Key    `grumble:"naturalkey=Vendor,Code;scoped=false"`
+	Vendor string
+	Code   string
+	Stock  int
+}
+
+type Branch struct {
+	Key
+	Name string `grumble:"key"`
+	City string
+}
+
+func TestNaturalKey(t *testing.T) {
+	registerKinds(t, &Sku{}, &Branch{})
+	sku := &Sku{Vendor: "acme", Code: "A-1", Stock: 5}
+	if err := mgr.Put(sku); err != nil {
+		t.Fatal(err)
+	}
+	if err := mgr.Put(&Sku{Vendor: "acme", Code: "A-1", Stock: 7}); err == nil {
+		t.Fatal("Could store duplicate natural key")
+	}
+	e, err := mgr.GetByNaturalKey(&Sku{}, nil, "acme", "A-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e == nil || e.Id() != sku.Id() {
+		t.Fatalf("GetByNaturalKey did not return Sku %d: %v", sku.Id(), e)
+	}
+	update := &Sku{Vendor: "acme", Code: "A-1", Stock: 9}
+	if err = mgr.Upsert(update); err != nil {
+		t.Fatal(err)
+	}
+	if update.Id() != sku.Id() {
+		t.Fatalf("Upsert created Sku %d instead of updating %d", update.Id(), sku.Id())
+	}
+	getMgr := freshManager(t)
+	e, err = getMgr.GetByNaturalKey(&Sku{}, nil, "acme", "A-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.(*Sku).Stock != 9 {
+		t.Fatalf("Upsert did not update Stock: %d", e.(*Sku).Stock)
+	}
+	if e, err = getMgr.GetByNaturalKey(&Sku{}, nil, "acme", "B-2"); err != nil || e != nil {
+		t.Fatalf("Expected no Sku, got %v, %v", e, err)
+	}
+
+	north, err := CreateDepartment(nil, "North", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	south, err := CreateDepartment(nil, "South", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, parent := range []*Department{north, south} {
+		branch, err := GetKind(&Branch{}).New(parent.AsKey())
+		if err != nil {
+			t.Fatal(err)
+		}
+		branch.(*Branch).Name = "Main"
+		if err = mgr.Put(branch); err != nil {
+			t.Fatalf("Scoped key not scoped to parent: %v", err)
+		}
+	}
+	e, err = mgr.GetByNaturalKey(&Branch{}, south.AsKey(), "Main")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e == nil || e.Parent().Id() != south.Id() {
+		t.Fatalf("GetByNaturalKey did not return the South branch: %v", e)
+	}
+}
+
+type Topic struct {
+	Key
+	Name string `grumble:"label"`
+}
+
+type Article struct {
+	Key
+	Title  string
+	Topics []*Topic
+}
+
+func TestManyToMany(t *testing.T) {
+	registerKinds(t, &Topic{}, &Article{})
+	topics := make([]*Topic, 0)
+	for _, name := range []string{"go", "sql", "web"} {
+		topic := &Topic{Name: name}
+		if err := mgr.Put(topic); err != nil {
+			t.Fatal(err)
+		}
+		topics = append(topics, topic)
+	}
+	first := &Article{Title: "First", Topics: []*Topic{topics[1], topics[0]}}
+	if err := mgr.Put(first); err != nil {
+		t.Fatal(err)
+	}
+	second := &Article{Title: "Second", Topics: []*Topic{topics[2]}}
+	if err := mgr.Put(second); err != nil {
+		t.Fatal(err)
+	}
+	if err := mgr.Put(&Article{Title: "Bad", Topics: []*Topic{{Name: "unsaved"}}}); err == nil {
+		t.Fatal("Could reference unsaved Topic")
+	}
+
+	getMgr := freshManager(t)
+	e, err := getMgr.Get(&Article{}, first.Id())
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := e.(*Article).Topics
+	if len(got) != 2 || got[0].Name != "sql" || got[1].Name != "go" {
+		t.Fatalf("Topics not loaded in order: %v", got)
+	}
+
+	q := getMgr.MakeQuery(&Article{})
+	q.AddCondition(&HasAnyOf{Field: "Topics", References: []*Topic{topics[0], topics[2]}})
+	results, err := q.Execute()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 {
+		t.Fatalf("Expected 2 articles with topic go or web, got %d", len(results))
+	}
+	q = getMgr.MakeQuery(&Article{})
+	q.AddFilter("Topics", topics[2])
+	results, err = q.Execute()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0][0].(*Article).Title != "Second" || len(results[0][0].(*Article).Topics) != 1 {
+		t.Fatalf("Expected article Second with topic web, got %v", results)
+	}
+
+	if _, err = Populate(first, map[string]interface{}{"Topics": topics[2].AsKey().String()}); err != nil {
+		t.Fatal(err)
+	}
+	if err = mgr.Put(first); err != nil {
+		t.Fatal(err)
+	}
+	getMgr = freshManager(t)
+	e, err = getMgr.Get(&Article{}, first.Id())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got = e.(*Article).Topics; len(got) != 1 || got[0].Id() != topics[2].Id() {
+		t.Fatalf("Topics not replaced on Put: %v", got)
+	}
+	if _, err = Populate(first, map[string]interface{}{"Topics": fmt.Sprintf("%d,%d", topics[0].Id(), topics[1].Id())}); err != nil {
+		t.Fatal(err)
+	}
+	if got = first.Topics; len(got) != 2 || got[1].Id() != topics[1].Id() {
+		t.Fatalf("Topics not set from list of ids: %v", got)
+	}
+}
+
+type Folder struct {
+	Key
+	Name  string
+	Notes []*Note `grumble:"children;sort=Title:DESC"`
+}
+
+type Note struct {
+	Key
+	Title string
+}
+
+type Memo struct {
+	Note
+	Recipient string
+}
+
+func TestChildCollection(t *testing.T) {
+	registerKinds(t, &Folder{}, &Note{}, &Memo{})
+	folders := make([]*Folder, 0)
+	for _, name := range []string{"Inbox", "Archive"} {
+		folder := &Folder{Name: name}
+		if err := mgr.Put(folder); err != nil {
+			t.Fatal(err)
+		}
+		folders = append(folders, folder)
+	}
+	for _, title := range []string{"a", "c"} {
+		note, err := mgr.New(&Note{}, folders[0].AsKey())
+		if err != nil {
+			t.Fatal(err)
+		}
+		note.(*Note).Title = title
+		if err = mgr.Put(note); err != nil {
+			t.Fatal(err)
+		}
+	}
+	memo, err := mgr.New(&Memo{}, folders[0].AsKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	memo.(*Memo).Title = "b"
+	memo.(*Memo).Recipient = "jan"
+	if err = mgr.Put(memo); err != nil {
+		t.Fatal(err)
+	}
+
+	getMgr := freshManager(t)
+	e, err := getMgr.Get(&Folder{}, folders[0].Id())
+	if err != nil {
+		t.Fatal(err)
+	}
+	inbox := e.(*Folder)
+	if inbox.Notes != nil {
+		t.Fatalf("Notes loaded by Get: %v", inbox.Notes)
+	}
+	if err = getMgr.LoadChildren(inbox); err != nil {
+		t.Fatal(err)
+	}
+	titles := ""
+	for _, note := range inbox.Notes {
+		titles += note.Title
+	}
+	if titles != "cba" {
+		t.Fatalf("Expected notes c, b, a, got %q", titles)
+	}
+	if inbox.Notes[1].Kind().Kind != GetKind(&Memo{}).Kind {
+		t.Fatalf("Derived Memo loaded as %s", inbox.Notes[1].Kind().Kind)
+	}
+
+	q := getMgr.MakeQuery(&Folder{})
+	q.AddCondition(&HasIds{Ids: []int{folders[0].Id(), folders[1].Id()}})
+	q.Preload("Notes")
+	results, err := q.Execute()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 {
+		t.Fatalf("Expected 2 folders, got %d", len(results))
+	}
+	for _, row := range results {
+		folder := row[0].(*Folder)
+		switch {
+		case folder.Id() == folders[0].Id() && len(folder.Notes) != 3:
+			t.Fatalf("Expected 3 notes in %s, got %d", folder.Name, len(folder.Notes))
+		case folder.Id() == folders[1].Id() && (folder.Notes == nil || len(folder.Notes) != 0):
+			t.Fatalf("Expected no notes in %s, got %v", folder.Name, folder.Notes)
+		}
+	}
+}
+
+type Comment struct {
+	Key
+	Text    string
+	Subject Persistable `grumble:"polymorphic=Article,Folder"`
+}
+
+func TestPolymorphicReference(t *testing.T) {
+	registerKinds(t, &Topic{}, &Article{}, &Folder{}, &Comment{})
+	article := &Article{Title: "Commented"}
+	if err := mgr.Put(article); err != nil {
+		t.Fatal(err)
+	}
+	folder := &Folder{Name: "Commented"}
+	if err := mgr.Put(folder); err != nil {
+		t.Fatal(err)
+	}
+	onArticle := &Comment{Text: "nice", Subject: article}
+	if err := mgr.Put(onArticle); err != nil {
+		t.Fatal(err)
+	}
+	if err := mgr.Put(&Comment{Text: "tidy", Subject: folder}); err != nil {
+		t.Fatal(err)
+	}
+	if err := mgr.Put(&Comment{Text: "nothing"}); err != nil {
+		t.Fatal(err)
+	}
+	topic := &Topic{Name: "off-topic"}
+	if err := mgr.Put(topic); err != nil {
+		t.Fatal(err)
+	}
+	if err := mgr.Put(&Comment{Text: "nope", Subject: topic}); err == nil {
+		t.Fatal("Could reference Topic from Comment")
+	}
+
+	getMgr := freshManager(t)
+	e, err := getMgr.Get(&Comment{}, onArticle.Id())
+	if err != nil {
+		t.Fatal(err)
+	}
+	subject, ok := e.(*Comment).Subject.(*Article)
+	if !ok || subject.Id() != article.Id() {
+		t.Fatalf("Subject not resolved to Article %d: %v", article.Id(), e.(*Comment).Subject)
+	}
+
+	q := getMgr.MakeQuery(&Comment{})
+	q.AddCondition(&ReferencesKind{Column: "Subject", Kinds: &Folder{}})
+	results, err := q.Execute()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0][0].(*Comment).Text != "tidy" {
+		t.Fatalf("Expected the comment on the folder, got %v", results)
+	}
+	q = getMgr.MakeQuery(&Comment{})
+	q.AddCondition(&References{Column: "Subject", References: article})
+	if results, err = q.Execute(); err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0][0].Id() != onArticle.Id() {
+		t.Fatalf("Expected the comment on the article, got %v", results)
+	}
+}
+
+type Vehicle struct {
+	Key    `grumble:"singletable"`
+	Make   string
+	Wheels int
+}
+
+type Car struct {
+	Vehicle
+	Doors int
+}
+
+type Truck struct {
+	Vehicle
+	Payload int
+}
+
+func TestSingleTable(t *testing.T) {
+	registerKinds(t, &Vehicle{}, &Car{}, &Truck{})
+	if err := mgr.Put(&Vehicle{Make: "Generic", Wheels: 3}); err != nil {
+		t.Fatal(err)
+	}
+	car, err := mgr.New(&Car{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	car.(*Car).Make = "Volvo"
+	car.(*Car).Wheels = 4
+	car.(*Car).Doors = 5
+	if err = mgr.Put(car); err != nil {
+		t.Fatal(err)
+	}
+	truck, err := mgr.New(&Truck{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	truck.(*Truck).Make = "Volvo"
+	truck.(*Truck).Wheels = 6
+	truck.(*Truck).Payload = 12000
+	if err = mgr.Put(truck); err != nil {
+		t.Fatal(err)
+	}
+
+	if GetKind(&Truck{}).QualifiedTableName() != GetKind(&Vehicle{}).QualifiedTableName() {
+		t.Fatalf("Truck is stored in %s", GetKind(&Truck{}).QualifiedTableName())
+	}
+	getMgr := freshManager(t)
+	e, err := getMgr.Get(&Truck{}, truck.Id())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e == nil || e.(*Truck).Payload != 12000 || e.(*Truck).Make != "Volvo" {
+		t.Fatalf("Truck not read back: %v", e)
+	}
+
+	q := getMgr.MakeQuery(&Vehicle{})
+	q.WithDerived = true
+	q.AddFilter("Make", "Volvo")
+	results, err := q.Execute()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 {
+		t.Fatalf("Expected 2 Volvos, got %d", len(results))
+	}
+	for _, row := range results {
+		if row[0].Kind().Kind != GetKind(&Car{}).Kind && row[0].Kind().Kind != GetKind(&Truck{}).Kind {
+			t.Fatalf("Volvo scanned as %s", row[0].Kind().Kind)
+		}
+	}
+	q = getMgr.MakeQuery(&Car{})
+	if results, err = q.Execute(); err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0][0].Id() != car.Id() {
+		t.Fatalf("Expected only the car, got %v", results)
+	}
+}
+
+func TestJSONSchema(t *testing.T) {
+	registerKinds(t, &Member{}, &Article{}, &Comment{})
+	schema := GetKind(&Member{}).JSONSchema("#/")
+	properties := schema["properties"].(map[string]interface{})
+	handle := properties["Handle"].(map[string]interface{})
+	if handle["type"] != "string" || handle["minLength"] != 3 || handle["maxLength"] != 12 {
+		t.Fatalf("Unexpected schema for Handle: %v", handle)
+	}
+	if required := schema["required"].([]string); len(required) != 1 || required[0] != "Handle" {
+		t.Fatalf("Unexpected required fields %v", required)
+	}
+	age := properties["Age"].(map[string]interface{})
+	if age["type"] != "integer" || age["minimum"] != 13.0 || age["maximum"] != 130.0 {
+		t.Fatalf("Unexpected schema for Age: %v", age)
+	}
+	nickname := properties["Nickname"].(map[string]interface{})
+	if !hasType(nickname, "null") || nickname["maxLength"] != 8 {
+		t.Fatalf("Unexpected schema for Nickname: %v", nickname)
+	}
+	if level := properties["Level"].(map[string]interface{}); len(level["enum"].([]interface{})) != 4 {
+		t.Fatalf("Unexpected schema for Level: %v", level)
+	}
+
+	properties = GetKind(&Article{}).JSONSchema("#/")["properties"].(map[string]interface{})
+	topics := properties["Topics"].(map[string]interface{})
+	if topics["type"] != "array" || topics["items"].(map[string]interface{})["$ref"] != "#/topic" {
+		t.Fatalf("Unexpected schema for Topics: %v", topics)
+	}
+	properties = GetKind(&Comment{}).JSONSchema("#/")["properties"].(map[string]interface{})
+	if subject := properties["Subject"].(map[string]interface{}); len(subject["anyOf"].([]interface{})) != 3 {
+		t.Fatalf("Unexpected schema for Subject: %v", subject)
+	}
+	if _, err := json.Marshal(JSONSchemas("#/")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+type Posting struct {
+	Key
+	Title  string  `grumble:"searchable=A"`
+	Body   string  `grumble:"searchable"`
+	Author *string `grumble:"searchable=B"`
+	Views  int
+}
+
+func TestSearch(t *testing.T) {
+	registerKinds(t, &Topic{}, &Posting{})
+	author := "Database Dan"
+	for _, p := range []*Posting{
+		{Title: "Cooking pasta", Body: "Boil water, then add the pasta"},
+		{Title: "Indexing tips", Body: "A database index speeds up lookups", Author: &author},
+		{Title: "Databases", Body: "Why every application needs a database"},
+	} {
+		if err := mgr.Put(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	q := mgr.MakeQuery(&Posting{})
+	q.Search("databases")
+	results, err := q.Execute()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 {
+		t.Fatalf("Expected 2 postings about databases, got %d", len(results))
+	}
+	if title := results[0][0].(*Posting).Title; title != "Databases" {
+		t.Fatalf("Expected the posting with 'Databases' in its title first, got %q", title)
+	}
+	rank, ok := results[0][0].SyntheticField(RankField)
+	if !ok {
+		t.Fatalf("No %s synthetic field", RankField)
+	}
+	if other, _ := results[1][0].SyntheticField(RankField); rank.(float64) <= other.(float64) {
+		t.Fatalf("Results not ordered by rank: %v, %v", rank, other)
+	}
+	if results, err = mgr.Query(&Posting{}, url.Values{"_q": {"pasta -water"}}); err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 0 {
+		t.Fatalf("Expected no results for 'pasta -water', got %d", len(results))
+	}
+	if results, err = mgr.Query(&Posting{}, url.Values{"_q": {"dan"}}); err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 {
+		t.Fatalf("Expected a result for the author, got %d", len(results))
+	}
+	// The search text is passed as a parameter, in the rank as well.
+	q = mgr.MakeQuery(&Posting{})
+	q.Search("database's index_")
+	if results, err = q.Execute(); err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 {
+		t.Fatalf("Expected 1 posting about database indexes, got %d", len(results))
+	}
+	if rank, _ = results[0][0].SyntheticField(RankField); rank.(float64) <= 0 {
+		t.Fatalf("Expected a positive rank, got %v", rank)
+	}
+	if _, err = mgr.Query(&Topic{}, url.Values{"_q": {"anything"}}); err == nil {
+		t.Fatal("Search on a kind without searchable fields did not fail")
+	}
+}
+
+type Ledger struct {
+	Key   `grumble:"renamedfrom=Book"`
+	Total int `grumble:"renamedfrom=Amount;index"`
+}
+
+func TestRename(t *testing.T) {
+	registerKinds(t, &Ledger{}, &Tally{})
+	ledger := &Ledger{Total: 42}
+	if err := mgr.Put(ledger); err != nil {
+		t.Fatal(err)
+	}
+	tally, err := mgr.New(&Tally{}, ledger.AsKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = mgr.Put(tally); err != nil {
+		t.Fatal(err)
+	}
+	k := GetKind(&Ledger{})
+	tallies := GetKind(&Tally{}).QualifiedTableName()
+	conn := mgr.PostgreSQLAdapter.GetConnection()
+	for _, s := range []string{
+		fmt.Sprintf("UPDATE %s SET \"_parent\" = ARRAY[('github.com.jandevisser.grumble.book', %d)::%q.\"Reference\"] WHERE \"_id\" = %d",
+			tallies, ledger.Id(), mgr.Schema, tally.Id()),
+		fmt.Sprintf("ALTER TABLE %s RENAME COLUMN \"Total\" TO \"Amount\"", k.QualifiedTableName()),
+		fmt.Sprintf("ALTER INDEX %q.\"ledger_Total\" RENAME TO \"ledger_Amount\"", mgr.Schema),
+		fmt.Sprintf("ALTER TABLE %s RENAME TO \"book\"", k.QualifiedTableName()),
+		fmt.Sprintf("ALTER INDEX %q.\"ledger__parent__id\" RENAME TO \"book__parent__id\"", mgr.Schema),
+	} {
+		if _, err := conn.Exec(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := k.Reconcile(mgr.PostgreSQLAdapter); err != nil {
+		t.Fatal(err)
+	}
+	getMgr := freshManager(t)
+	e, err := getMgr.Get(&Ledger{}, ledger.Id())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e == nil || e.(*Ledger).Total != 42 {
+		t.Fatalf("Ledger not kept through the rename: %v", e)
+	}
+	var parentKind string
+	if err = conn.QueryRow(fmt.Sprintf("SELECT (\"_parent\"[1]).\"kind\" FROM %s WHERE \"_id\" = $1", tallies),
+		tally.Id()).Scan(&parentKind); err != nil {
+		t.Fatal(err)
+	}
+	if parentKind != k.Kind {
+		t.Fatalf("Reference to the renamed kind not rewritten: %q", parentKind)
+	}
+	var count int
+	if err = conn.QueryRow("SELECT COUNT(*) FROM pg_indexes WHERE schemaname = $1 AND indexname IN ('ledger_Total', 'ledger__parent__id')",
+		mgr.Schema).Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 {
+		t.Fatalf("Expected the indexes to be renamed, found %d", count)
+	}
+	if GetKind("github.com.jandevisser.grumble.book") != k {
+		t.Fatal("Previous kind name does not resolve to Ledger")
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	registerKinds(t, &Posting{}, &Ledger{})
+	err := RegisterMigration(&Ledger{}, 1, "double_totals", func(mgr *EntityManager, tx *sql.Tx) (err error) {
+		_, err = tx.Exec(fmt.Sprintf("UPDATE %s SET \"Total\" = \"Total\" * 2", GetKind(&Ledger{}).QualifiedTableName()))
+		return
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = RegisterMigration(&Ledger{}, 1, "again", nil); err == nil {
+		t.Fatal("Registering a duplicate migration version did not fail")
+	}
+	if err = RegisterMigrationDir(nil, "testdata/migrations"); err != nil {
+		t.Fatal(err)
+	}
+	for pass := 0; pass < 2; pass++ {
+		status, err := mgr.Migrate()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(status) != 2 || !status[0].Applied || !status[1].Applied {
+			t.Fatalf("Expected 2 applied migrations, got %v", status)
+		}
+		if status[0].Kind != GetKind(&Ledger{}) || status[1].Scope() != "" || status[1].Name != "count_views" {
+			t.Fatalf("Migrations not in order: %v, %v", status[0].Migration, status[1].Migration)
+		}
+		// Record the migration under the previous name of Ledger, as if
+		// it was applied before the rename.
+		if _, err = mgr.PostgreSQLAdapter.GetConnection().Exec(fmt.Sprintf("UPDATE %q.%q SET \"scope\" = 'github.com.jandevisser.grumble.book' WHERE \"scope\" = $1", mgr.Schema, MigrationTable),
+			GetKind(&Ledger{}).Kind); err != nil {
+			t.Fatal(err)
+		}
+	}
+	getMgr := freshManager(t)
+	results, err := getMgr.MakeQuery(&Ledger{}).Execute()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0][0].(*Ledger).Total != 84 {
+		t.Fatalf("Ledger not migrated exactly once: %v", results)
+	}
+	if results, err = getMgr.MakeQuery(&Posting{}).Execute(); err != nil {
+		t.Fatal(err)
+	}
+	for _, row := range results {
+		if views := row[0].(*Posting).Views; views != 1 {
+			t.Fatalf("Posting migrated %d times", views)
+		}
+	}
+
+	// A failing migration is rolled back as a whole.
+	ledgers := GetKind(&Ledger{})
+	err = RegisterMigration(&Ledger{}, 2, "fails", func(mgr *EntityManager, tx *sql.Tx) (err error) {
+		if _, err = tx.Exec(fmt.Sprintf("UPDATE %s SET \"Total\" = 0", ledgers.QualifiedTableName())); err != nil {
+			return
+		}
+		return errors.New("halfway")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		migrations[ledgers.Kind] = migrations[ledgers.Kind][:1]
+	}()
+	if _, err = mgr.Migrate(); err == nil {
+		t.Fatal("Failing migration did not fail Migrate")
+	}
+	status, err := mgr.MigrationStatus()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := status[1]; s.Version != 2 || s.Applied {
+		t.Fatalf("Failed migration recorded as applied: %v", s)
+	}
+	if results, err = freshManager(t).MakeQuery(&Ledger{}).Execute(); err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0][0].(*Ledger).Total != 84 {
+		t.Fatalf("Failed migration not rolled back: %v", results)
+	}
+}
+
+func TestGetMulti(t *testing.T) {
+	registerKinds(t, &Posting{}, &Ledger{})
+	posting := &Posting{Title: "Batching"}
+	ledger := &Ledger{Total: 7}
+	for _, e := range []Persistable{posting, ledger} {
+		if err := mgr.Put(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	missing, _ := CreateKey(nil, GetKind(&Posting{}), 1000000)
+	getMgr := freshManager(t)
+	e, err := getMgr.GetByKey(ledger.AsKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e == nil || e.(*Ledger).Total != 7 {
+		t.Fatalf("GetByKey returned %v", e)
+	}
+	entities, err := getMgr.GetMulti([]*Key{posting.AsKey(), nil, missing, ledger.AsKey(), posting.AsKey()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entities) != 5 || entities[1] != nil || entities[2] != nil {
+		t.Fatalf("Unexpected entities %v", entities)
+	}
+	if p, ok := entities[0].(*Posting); !ok || p.Title != "Batching" || entities[4] != entities[0] {
+		t.Fatalf("Posting not returned in order: %v", entities)
+	}
+	if entities[3] != e {
+		t.Fatalf("Cached ledger not returned: %v", entities[3])
+	}
+}
+
+func TestDescendants(t *testing.T) {
+	registerKinds(t, &Branch{})
+	top, err := CreateDepartment(nil, "Tree", "Top of the tree")
+	if err != nil {
+		t.Fatal(err)
+	}
+	branch, err := CreateDepartment(top, "Branch", "Below the top")
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := CreateDepartment(branch, "Leaf", "Below the branch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := mgr.New(&Product{}, branch.AsKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.(*Product).Name = "Acorn"
+	if err = mgr.Put(e); err != nil {
+		t.Fatal(err)
+	}
+
+	getMgr := freshManager(t)
+	tree, err := getMgr.Descendants(top.AsKey(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tree.Entity.Id() != top.Id() || len(tree.Children) != 1 {
+		t.Fatalf("Expected the top with one child, got %v", tree)
+	}
+	if node := tree.Children[0]; node.Entity.Id() != branch.Id() || len(node.Children) != 2 {
+		t.Fatalf("Expected the branch with two children, got %v", node)
+	}
+	if tree, err = getMgr.Descendants(top.AsKey(), 1, &Department{}); err != nil {
+		t.Fatal(err)
+	}
+	if len(tree.Children) != 1 || len(tree.Children[0].Children) != 0 {
+		t.Fatalf("Expected one level of departments, got %v", tree.Children)
+	}
+
+	ancestors, err := getMgr.Ancestors(leaf.AsKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ancestors) != 2 || ancestors[0].Id() != top.Id() || ancestors[1].(*Department).Name != "Branch" {
+		t.Fatalf("Unexpected ancestors %v", ancestors)
+	}
+}
+
+func TestMove(t *testing.T) {
+	from, err := CreateDepartment(nil, "From", "Old root")
+	if err != nil {
+		t.Fatal(err)
+	}
+	to, err := CreateDepartment(nil, "To", "New root")
+	if err != nil {
+		t.Fatal(err)
+	}
+	moved, err := CreateDepartment(from, "Moved", "Moves with its subtree")
+	if err != nil {
+		t.Fatal(err)
+	}
+	below, err := CreateDepartment(moved, "Below", "Below the moved department")
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := mgr.New(&Product{}, below.AsKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.(*Product).Name = "Passenger"
+	if err = mgr.Put(e); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = mgr.Move(moved, to); err != nil {
+		t.Fatal(err)
+	}
+	if err = mgr.Move(to, below); err == nil {
+		t.Fatal("Moving a department below its descendant did not fail")
+	}
+
+	getMgr := freshManager(t)
+	ancestors, err := getMgr.Ancestors(e.AsKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ancestors) != 3 || ancestors[0].Id() != to.Id() || ancestors[1].Id() != moved.Id() || ancestors[2].Id() != below.Id() {
+		t.Fatalf("Unexpected ancestors after move: %v", ancestors)
+	}
+	tree, err := getMgr.Descendants(from.AsKey(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tree.Children) != 0 {
+		t.Fatalf("Old root still has descendants: %v", tree.Children)
+	}
+
+	// Adopt moves stored children and puts their other changes as well.
+	below.SetManager(mgr)
+	below.Description = "Adopted"
+	if err = mgr.Adopt(from, []Persistable{below}); err != nil {
+		t.Fatal(err)
+	}
+	adopted, err := freshManager(t).Get(&Department{}, below.Id())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if adopted.Parent().Id() != from.Id() || adopted.(*Department).Description != "Adopted" {
+		t.Fatalf("Adopted department not moved and put: %v %q", adopted.Parent(), adopted.(*Department).Description)
+	}
+}
@@ -33,6 +33,7 @@ import (
 	"unicode/utf8"
 
 	"github.com/JanDeVisser/grumble"
+	"github.com/google/uuid"
 )
 
 type EntityRequest struct {
@@ -60,7 +61,6 @@ func NewEntityRequest(mgr *grumble.EntityManager, w http.ResponseWriter, r *http
 		ret.Kind = grumble.GetKind(s[0])
 	}
 
-	var id int64 = 0
 	switch {
 	case ret.Kind == nil:
 		break
@@ -72,17 +72,13 @@ func NewEntityRequest(mgr *grumble.EntityManager, w http.ResponseWriter, r *http
 		ret.Mode = "new"
 		return
 	case len(s) == 2:
-		id, err = strconv.ParseInt(s[1], 0, 0)
-		if err != nil {
+		if ret.Id, err = grumble.ParseId(ret.Kind, s[1]); err != nil {
 			return
 		}
-		ret.Id = int(id)
 	case r.FormValue("Id") != "":
-		id, err = strconv.ParseInt(r.FormValue("Id"), 0, 0)
-		if err != nil {
+		if ret.Id, err = grumble.ParseId(ret.Kind, r.FormValue("Id")); err != nil {
 			return
 		}
-		ret.Id = int(id)
 	case len(s) == 1:
 		ret.Id = -1
 	default:
@@ -136,6 +132,11 @@ func (req *EntityRequest) makeContext(e grumble.Persistable, p grumble.Persistab
 	} else {
 		data["ParentIdent"] = 0
 	}
+	if data["Mode"] == "view" && len(e.Kind().Children) > 0 {
+		if err = e.Manager().LoadChildren(e); err != nil {
+			return
+		}
+	}
 	m := reflect.ValueOf(e).MethodByName("MakeContext")
 	if m.IsValid() {
 		rv := m.Call([]reflect.Value{reflect.ValueOf(data)})
@@ -249,12 +250,12 @@ func (req *EntityRequest) GET() {
 						fmt.Sprintf("%s: no pid in new request", req.Kind.Basename()),
 						http.StatusInternalServerError)
 				}
-				pid, err := strconv.ParseInt(parentIdStr, 0, 0)
+				pid, err := grumble.ParseId(req.Kind.ParentKind, parentIdStr)
 				if err != nil {
 					http.Error(req.w, err.Error(), http.StatusInternalServerError)
 					return
 				}
-				p, err = req.Manager.Get(req.Kind.ParentKind, int(pid))
+				p, err = req.Manager.Get(req.Kind.ParentKind, pid)
 				if err != nil {
 					http.Error(req.w, err.Error(), http.StatusInternalServerError)
 					return
@@ -347,13 +348,13 @@ func (req *EntityRequest) POST() {
 					log.Print(err)
 					http.Error(req.w, err.Error(), http.StatusInternalServerError)
 				}
-				pid, err := strconv.ParseInt(parentIdStr, 0, 0)
+				pid, err := grumble.ParseId(req.Kind.ParentKind, parentIdStr)
 				if err != nil {
 					log.Print(err)
 					http.Error(req.w, err.Error(), http.StatusInternalServerError)
 					return
 				}
-				p, err := req.Manager.Get(req.Kind.ParentKind, int(pid))
+				p, err := req.Manager.Get(req.Kind.ParentKind, pid)
 				if err != nil {
 					log.Print(err)
 					http.Error(req.w, err.Error(), http.StatusInternalServerError)
@@ -379,7 +380,11 @@ func (req *EntityRequest) POST() {
 			if !unicode.IsUpper(r) {
 				continue
 			}
-			attribs[field] = value[0]
+			if _, ok := req.Kind.Link(field); ok {
+				attribs[field] = value
+			} else {
+				attribs[field] = value[0]
+			}
 		}
 
 		v := reflect.ValueOf(entity)
@@ -403,6 +408,10 @@ func (req *EntityRequest) POST() {
 			}
 		}
 
+		if errs, ok := err.(grumble.ValidationErrors); ok {
+			req.rerender(entity, errs)
+			return
+		}
 		if err != nil {
 			log.Print(err)
 			http.Error(req.w, err.Error(), http.StatusInternalServerError)
@@ -420,6 +429,25 @@ func (req *EntityRequest) POST() {
 	}
 }
 
+// rerender serves the form for entity again, with the messages in errs, after
+// a POST failed validation.
+func (req *EntityRequest) rerender(entity grumble.Persistable, errs grumble.ValidationErrors) {
+	var p grumble.Persistable = entity.Parent()
+	if err := req.makeContext(entity, p); err != nil {
+		log.Print(err)
+		http.Error(req.w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	data := req.Data.(map[string]interface{})
+	data["Mode"] = req.Mode
+	if req.Mode == "" {
+		data["Mode"] = "new"
+	}
+	data["Errors"] = errs
+	req.w.WriteHeader(http.StatusUnprocessableEntity)
+	req.serveTemplate()
+}
+
 func (req *EntityRequest) serveTemplate() {
 	templateManager.Serve(req.Template, req.Data, EntityTmpl, req.w, req.r)
 }
@@ -475,6 +503,7 @@ type BasicFieldContext struct {
 	Entity    grumble.Persistable
 	Column    grumble.Column
 	FieldName string
+	Errors    []string
 }
 
 func MakeBasicFieldContext(data map[string]interface{}, e grumble.Persistable, col grumble.Column, args ...interface{}) (ret *BasicFieldContext) {
@@ -487,6 +516,9 @@ func MakeBasicFieldContext(data map[string]interface{}, e grumble.Persistable, c
 	if ret.Label == "" {
 		ret.Label = col.VerboseName
 	}
+	if errs, ok := data["Errors"].(grumble.ValidationErrors); ok {
+		ret.Errors = errs[col.FieldName]
+	}
 	ret.Tags.Merge(col.Tags)
 	if converter, ok := col.Converter.(*grumble.BasicConverter); ok {
 		switch {
@@ -520,18 +552,44 @@ func MakeBasicFieldContext(data map[string]interface{}, e grumble.Persistable, c
 				value := reflect.ValueOf(val)
 				ret.Value = strconv.FormatFloat(value.Float(), 'f', -1, 64)
 			}
+		case converter.GoType == reflect.TypeOf(grumble.Decimal{}):
+			ret.Template = "FloatField"
+			ret.InputType = "number"
+			step := "any"
+			if scale, ok := ret.Tags.GetInt("scale"); ok {
+				step = grumble.NewDecimal(1, scale).String()
+			}
+			ret.Tags.Set("step", step)
+			if val, ok := grumble.Field(e, col.FieldName); ok {
+				if d, ok := val.(grumble.Decimal); ok {
+					ret.Value = d.String()
+				}
+			}
 		case converter.GoType == reflect.TypeOf(time.Time{}):
 			ret.Template = "BasicField"
-			ret.InputType = "date" // FIXME Can be time as well
+			ret.InputType = "date"
+			viewLayout, editLayout := "Mon Jan 2, 2006", "2006-01-02"
+			if tz, ok := ret.Tags.GetBool("tz"); ok && tz {
+				ret.InputType = "datetime-local"
+				viewLayout, editLayout = "Mon Jan 2, 2006 15:04 MST", "2006-01-02T15:04"
+			}
 			if val, ok := grumble.Field(e, col.FieldName); ok {
 				if date, ok := val.(time.Time); ok {
 					if ret.Mode == "view" {
-						ret.Value = date.Format("Mon Jan 2, 2006")
+						ret.Value = date.Format(viewLayout)
 					} else {
-						ret.Value = date.Format("2006-01-02")
+						ret.Value = date.Format(editLayout)
 					}
 				}
 			}
+		case converter.GoType == reflect.TypeOf(uuid.UUID{}):
+			ret.Template = "BasicField"
+			ret.InputType = "text"
+			if val, ok := grumble.Field(e, col.FieldName); ok {
+				if id, ok := val.(uuid.UUID); ok && id != uuid.Nil {
+					ret.Value = id.String()
+				}
+			}
 		}
 		if ret.Tags.Has("inputtype") {
 			ret.InputType = ret.Tags.Get("inputtype")
@@ -587,12 +645,138 @@ func MakeLookupContext(basicCtx *BasicFieldContext) (ret *LookupContext) {
 		if ret.Tags.Has("display") {
 			ret.DisplayExpr, _ = url.QueryUnescape(refKind.Tags.Get("display"))
 		}
+	} else if _, ok := ret.Column.Converter.(*grumble.PolymorphicReferenceConverter); ok {
+		ret.ReferenceJSON = "null"
+		if ref, ok := grumble.Field(ret.Entity, ret.FieldName); ok {
+			stub := ref.(grumble.Persistable)
+			if reference, err := ret.Entity.Manager().Get(stub.Kind(), stub.Id()); err == nil && reference != nil {
+				ret.Reference = reference
+				json, _ := Marshal(ret.Reference)
+				ret.ReferenceJSON = string(json)
+				ret.Value = grumble.Label(ret.Reference)
+				ret.HRef = fmt.Sprintf("/%s/%d", reference.Kind().Basename(), reference.Id())
+			}
+		}
+	}
+	return
+}
+
+type EnumContext struct {
+	BasicFieldContext
+	Options []string
+}
+
+func MakeEnumContext(basicCtx *BasicFieldContext) (ret *EnumContext) {
+	ret = &EnumContext{}
+	ret.BasicFieldContext = *basicCtx
+	ret.Template = "Select"
+	if converter, ok := ret.Column.Converter.(*grumble.EnumConverter); ok {
+		ret.Options = converter.Values
+		if val, ok := grumble.Field(ret.Entity, ret.FieldName); ok {
+			ret.Value, _ = converter.Label(val)
+		}
+	}
+	return
+}
+
+type MultiSelectOption struct {
+	Key      string
+	Label    string
+	HRef     string
+	Selected bool
+}
+
+type MultiSelectContext struct {
+	BaseContext
+	Entity    grumble.Persistable
+	Link      *grumble.ManyToMany
+	FieldName string
+	Errors    []string
+	Options   []MultiSelectOption
+	More      bool
+	Query     string
+}
+
+// MultiSelectLimit is the maximum number of entities offered as options by
+// MakeMultiSelectContext, unless the field has a limit tag.
+var MultiSelectLimit = 100
+
+// MakeMultiSelectContext builds the context for editing a many-to-many
+// field. The options are the entities currently in the field, which are
+// selected, and at most MultiSelectLimit other entities of the referenced
+// Kind. If there are more, More is set and Query holds the query string to
+// look them up through the JSON handler. In view mode, Value holds the
+// labels of the selected entities.
+func MakeMultiSelectContext(data map[string]interface{}, e grumble.Persistable, link *grumble.ManyToMany, args ...interface{}) (ret *MultiSelectContext) {
+	ret = &MultiSelectContext{
+		BaseContext: *MakeBaseContext(data, args...),
+		Entity:      e,
+		Link:        link,
+		FieldName:   link.FieldName,
+		Options:     make([]MultiSelectOption, 0),
+	}
+	ret.Template = "MultiSelect"
+	if ret.Label == "" {
+		ret.Label = link.VerboseName
+	}
+	if errs, ok := data["Errors"].(grumble.ValidationErrors); ok {
+		ret.Errors = errs[link.FieldName]
+	}
+	ret.Tags.Merge(link.Tags)
+	seen := make(map[string]bool)
+	addOption := func(target grumble.Persistable, selected bool) {
+		key := target.AsKey().String()
+		if seen[key] {
+			return
+		}
+		seen[key] = true
+		ret.Options = append(ret.Options, MultiSelectOption{
+			Key:      key,
+			Label:    grumble.Label(target),
+			HRef:     fmt.Sprintf("/%s/%d", target.Kind().Basename(), target.Id()),
+			Selected: selected,
+		})
+	}
+	labels := make([]string, 0)
+	fld := reflect.ValueOf(e).Elem().FieldByIndex(link.Index)
+	for ix := 0; ix < fld.Len(); ix++ {
+		if target, ok := fld.Index(ix).Interface().(grumble.Persistable); ok && !fld.Index(ix).IsNil() {
+			addOption(target, true)
+			labels = append(labels, grumble.Label(target))
+		}
+	}
+	ret.Value = strings.Join(labels, ", ")
+	limit := MultiSelectLimit
+	if l, ok := ret.Tags.GetInt("limit"); ok && l > 0 {
+		limit = l
+	}
+	q := e.Manager().MakeQuery(link.References)
+	q.WithDerived = true
+	q.Limit = limit + 1
+	if link.References.LabelCol != "" {
+		q.AddSort(grumble.Sort{Column: link.References.LabelCol})
+		ret.Query = fmt.Sprintf("_re=true&%s=", link.References.LabelCol)
+	}
+	results, err := q.Execute()
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	if len(results) > limit {
+		ret.More = true
+		results = results[:limit]
+	}
+	for _, row := range results {
+		addOption(row[0], false)
 	}
 	return
 }
 
 func MakeFieldContext(data map[string]interface{}, e grumble.Persistable, field string, args ...interface{}) (ret interface{}) {
 	k := e.Kind()
+	if link, ok := k.Link(field); ok {
+		return MakeMultiSelectContext(data, e, link, args...)
+	}
 	if col, ok := k.ColumnByFieldName(field); !ok {
 		return nil
 	} else {
@@ -604,6 +788,10 @@ func MakeFieldContext(data map[string]interface{}, e grumble.Persistable, field
 			//fmt.Println(converter)
 			_ = converter
 			return MakeLookupContext(basicCtx)
+		case *grumble.PolymorphicReferenceConverter:
+			return MakeLookupContext(basicCtx)
+		case *grumble.EnumConverter:
+			return MakeEnumContext(basicCtx)
 		case *grumble.BasicConverter:
 			return basicCtx
 		}
@@ -28,7 +28,6 @@ import (
 	"log"
 	"net/http"
 	"reflect"
-	"strconv"
 	"strings"
 )
 
@@ -121,6 +120,7 @@ func MarshalPersistableToMap(obj grumble.Persistable) (jsonData map[string]inter
 		return
 	}
 	jsonData["_kind"] = k.Basename()
+	jsonData["_key"] = obj.AsKey().Encode()
 	for name, value := range obj.SyntheticFields() {
 		if name != "_parent" {
 			if marshalled, err := MarshalToMap(value); err != nil {
@@ -218,6 +218,20 @@ func (req *JSONRequest) GET() {
 	}
 }
 
+// WriteValidationErrors responds with status 422 and a JSON object holding
+// the messages in errs, keyed by field name.
+func WriteValidationErrors(w http.ResponseWriter, errs grumble.ValidationErrors) {
+	jsonText, err := json.Marshal(map[string]interface{}{"errors": errs})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Add("Content-type", "application/json")
+	w.WriteHeader(http.StatusUnprocessableEntity)
+	_, _ = w.Write(jsonText)
+	_, _ = w.Write([]byte("\n"))
+}
+
 func JSON(w http.ResponseWriter, r *http.Request) {
 	log.Printf("%s JSON: %s?%s", r.Method, r.URL.Path, r.URL.RawQuery)
 	mgr, err := grumble.MakeEntityManager()
@@ -231,22 +245,22 @@ func JSON(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, fmt.Sprintf("Unknown kind '%s'", s[1]), http.StatusInternalServerError)
 		return
 	}
-	var id int64 = 0
+	id := 0
 	switch {
 	case len(s) == 3:
-		id, err = strconv.ParseInt(s[2], 0, 0)
+		id, err = grumble.ParseId(kind, s[2])
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 	case r.FormValue("id") != "":
-		id, err = strconv.ParseInt(r.FormValue("id"), 0, 0)
+		id, err = grumble.ParseId(kind, r.FormValue("id"))
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 	}
-	req := &JSONRequest{mgr: mgr, Method: r.Method, Kind: kind, Id: int(id), w: w, r: r}
+	req := &JSONRequest{mgr: mgr, Method: r.Method, Kind: kind, Id: id, w: w, r: r}
 	req.Execute()
 }
 
@@ -294,6 +308,10 @@ func JSONSubmit(w http.ResponseWriter, r *http.Request) {
 			ret = true
 		}
 	}
+	if errs, ok := ret.(grumble.ValidationErrors); ok {
+		WriteValidationErrors(w, errs)
+		return
+	}
 
 	jsonText, err = json.Marshal(ret)
 	if err != nil {
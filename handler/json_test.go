@@ -20,8 +20,11 @@
 package handler
 
 import (
+	"encoding/json"
 	"errors"
 	"github.com/JanDeVisser/grumble"
+	"net/http"
+	"net/http/httptest"
 	"testing"
 )
 
@@ -83,6 +86,12 @@ func TestMarshalPersistable(t *testing.T) {
 	if err != nil {
 		t.Errorf("Error creating entity manager: %v", err)
 	}
+	if err = grumble.Register(&Person{}); err != nil {
+		t.Fatalf("Error registering kind: %v", err)
+	}
+	if err = grumble.ReconcileAll(mgr.PostgreSQLAdapter); err != nil {
+		t.Fatalf("Error reconciling kinds: %v", err)
+	}
 	e, err := mgr.Make(grumble.GetKind(Person{}), grumble.ZeroKey, 0)
 	if err != nil {
 		t.Errorf("Error creating entity: %v", err)
@@ -116,3 +125,56 @@ func TestMarshalPersistable(t *testing.T) {
 		t.Log(string(m))
 	}
 }
+
+func TestWriteValidationErrors(t *testing.T) {
+	w := httptest.NewRecorder()
+	WriteValidationErrors(w, grumble.ValidationErrors{"FirstName": {"is required"}})
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("Expected status %d, got %d", http.StatusUnprocessableEntity, w.Code)
+	}
+	var body map[string]map[string][]string
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	if msgs := body["errors"]["FirstName"]; len(msgs) != 1 || msgs[0] != "is required" {
+		t.Fatalf("Unexpected error map %v", body)
+	}
+}
+
+func TestOpenAPI(t *testing.T) {
+	if err := grumble.Register(&Person{}); err != nil {
+		t.Fatalf("Error registering kind: %v", err)
+	}
+	w := httptest.NewRecorder()
+	JSONSchema(w, httptest.NewRequest(http.MethodGet, "/schema/openapi.json", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	var doc struct {
+		Paths      map[string]map[string]interface{}
+		Components struct {
+			Schemas map[string]struct {
+				Properties map[string]interface{}
+			}
+		}
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &doc); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := doc.Paths["/json/person/{id}"]["get"]; !ok {
+		t.Errorf("No get route for person: %v", doc.Paths)
+	}
+	if _, ok := doc.Components.Schemas["person"].Properties["FirstName"]; !ok {
+		t.Errorf("No FirstName property in person schema: %v", doc.Components.Schemas["person"])
+	}
+
+	w = httptest.NewRecorder()
+	JSONSchema(w, httptest.NewRequest(http.MethodGet, "/schema/person", nil))
+	var schema map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &schema); err != nil {
+		t.Fatal(err)
+	}
+	if schema["$id"] != "/schema/person" {
+		t.Errorf("Unexpected $id %v", schema["$id"])
+	}
+}
@@ -0,0 +1,218 @@
+/*
+ * This file is part of Finn.
+ *
+ * Copyright (c) 2019 Jan de Visser <jan@finiandarcy.com>
+ *
+ * Finn is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Finn is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with Finn.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/JanDeVisser/grumble"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+const jsonSchemaDialect = "https://json-schema.org/draft/2020-12/schema"
+
+// jsonMounts returns the path prefixes the JSON handler is mounted on.
+func jsonMounts() (prefixes []string) {
+	for _, mount := range config.Mounts {
+		if mount.Handler == "JSON" && !mount.Static {
+			prefixes = append(prefixes, strings.TrimSuffix(mount.Pattern, "/"))
+		}
+	}
+	if len(prefixes) == 0 {
+		prefixes = append(prefixes, "/json")
+	}
+	return
+}
+
+func ref(name string) map[string]interface{} {
+	return map[string]interface{}{"$ref": "#/components/schemas/" + name}
+}
+
+func jsonContent(schema map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{"application/json": map[string]interface{}{"schema": schema}}
+}
+
+// OpenAPI returns an OpenAPI 3.1 document describing the routes served by
+// the JSON handler for all registered Kinds. The schemas of the Kinds are
+// the ones returned by Kind.JSONSchema.
+func OpenAPI() (doc map[string]interface{}) {
+	kinds := grumble.Kinds()
+	sort.Slice(kinds, func(i, j int) bool {
+		return kinds[i].Kind < kinds[j].Kind
+	})
+	schemas := grumble.JSONSchemas("#/components/schemas/")
+	errorResponse := map[string]interface{}{
+		"description": "Error",
+		"content":     map[string]interface{}{"text/plain": map[string]interface{}{"schema": map[string]interface{}{"type": "string"}}},
+	}
+	paths := make(map[string]interface{})
+	for ix, prefix := range jsonMounts() {
+		for _, k := range kinds {
+			name := k.Basename()
+			title := strings.Title(name)
+			if ix > 0 {
+				title += fmt.Sprintf("%d", ix)
+			}
+			entity := map[string]interface{}{"description": k.VerboseName, "content": jsonContent(ref(name))}
+			parameters := make([]interface{}, 0)
+			for _, column := range k.Columns {
+				parameters = append(parameters, map[string]interface{}{
+					"name":        column.FieldName,
+					"in":          "query",
+					"description": fmt.Sprintf("Only return entities with this %s", column.VerboseName),
+					"schema":      map[string]interface{}{"type": "string"},
+				})
+			}
+			for _, link := range k.Links {
+				parameters = append(parameters, map[string]interface{}{
+					"name":        link.FieldName,
+					"in":          "query",
+					"description": fmt.Sprintf("Comma separated ids or encoded keys; only return entities linked to one of them in %s", link.VerboseName),
+					"schema":      map[string]interface{}{"type": "string"},
+				})
+			}
+			for _, param := range [][2]string{
+				{"_parent", "Only return entities with this parent key"},
+				{"_sort", "Semicolon separated list of Field or Field:DESC"},
+				{"_null", "Comma separated fields that must be NULL"},
+				{"_notnull", "Comma separated fields that must not be NULL"},
+				{"_re", "Match field values as case insensitive regular expressions"},
+				{"_array", "Operator used for array fields"},
+				{"joinparent", "Kind of the ancestors to join"},
+			} {
+				parameters = append(parameters, map[string]interface{}{
+					"name":        param[0],
+					"in":          "query",
+					"description": param[1],
+					"schema":      map[string]interface{}{"type": "string"},
+				})
+			}
+			if k.Searchable() {
+				parameters = append(parameters, map[string]interface{}{
+					"name":        "_q",
+					"in":          "query",
+					"description": "Full-text search on the searchable fields. Results are ordered by _rank",
+					"schema":      map[string]interface{}{"type": "string"},
+				})
+			}
+			paths[prefix+"/"+name] = map[string]interface{}{
+				"get": map[string]interface{}{
+					"operationId": "query" + title,
+					"summary":     "Query " + k.VerboseName,
+					"tags":        []string{name},
+					"parameters":  parameters,
+					"responses": map[string]interface{}{
+						"200": map[string]interface{}{
+							"description": "Result rows. The first entity of each row is a " + k.VerboseName +
+								", followed by the joined entities",
+							"content": jsonContent(map[string]interface{}{
+								"type": "array",
+								"items": map[string]interface{}{
+									"type":        "array",
+									"prefixItems": []interface{}{ref(name)},
+									"items":       map[string]interface{}{"type": "object"},
+								},
+							}),
+						},
+						"500": errorResponse,
+					},
+				},
+			}
+			paths[prefix+"/"+name+"/{id}"] = map[string]interface{}{
+				"parameters": []interface{}{
+					map[string]interface{}{
+						"name":        "id",
+						"in":          "path",
+						"required":    true,
+						"description": "The id of the entity, or its encoded key",
+						"schema":      map[string]interface{}{"type": []string{"integer", "string"}},
+					},
+				},
+				"get": map[string]interface{}{
+					"operationId": "get" + title,
+					"summary":     "Get " + k.VerboseName,
+					"tags":        []string{name},
+					"responses":   map[string]interface{}{"200": entity, "500": errorResponse},
+				},
+			}
+		}
+	}
+	info := map[string]interface{}{"title": config.AppId, "version": config.Version}
+	if config.About != nil && config.About.AppName != "" {
+		info["title"] = config.About.AppName
+	}
+	if info["title"] == "" {
+		info["title"] = "grumble"
+	}
+	if info["version"] == "" {
+		info["version"] = "0"
+	}
+	return map[string]interface{}{
+		"openapi":           "3.1.0",
+		"jsonSchemaDialect": jsonSchemaDialect,
+		"info":              info,
+		"paths":             paths,
+		"components":        map[string]interface{}{"schemas": schemas},
+	}
+}
+
+// JSONSchema serves the metadata of the registered Kinds. Mounted on
+// /schema/, it serves the OpenAPI document for the JSON handler routes on
+// /schema/openapi.json, the JSON Schema of a Kind on /schema/<kind>, and the
+// schemas of all Kinds as $defs keyed by Kind basename on /schema/.
+func JSONSchema(w http.ResponseWriter, r *http.Request) {
+	log.Printf("%s JSONSchema: %s", r.Method, r.URL.Path)
+	if r.Method != http.MethodGet {
+		http.Error(w, fmt.Sprintf("Cannot serve method %q for schema requests", r.Method), http.StatusMethodNotAllowed)
+		return
+	}
+	s := strings.Split(r.URL.Path[1:], "/")
+	refPrefix := "/" + s[0] + "/"
+	var doc map[string]interface{}
+	switch {
+	case len(s) < 2 || s[1] == "":
+		doc = map[string]interface{}{
+			"$schema": jsonSchemaDialect,
+			"$defs":   grumble.JSONSchemas(refPrefix),
+		}
+	case s[1] == "openapi.json":
+		doc = OpenAPI()
+	default:
+		kind := grumble.GetKind(s[1])
+		if kind == nil {
+			http.Error(w, fmt.Sprintf("Unknown kind '%s'", s[1]), http.StatusNotFound)
+			return
+		}
+		doc = kind.JSONSchema(refPrefix)
+		doc["$schema"] = jsonSchemaDialect
+		doc["$id"] = refPrefix + kind.Basename()
+	}
+	jsonText, err := json.Marshal(doc)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Add("Content-type", "application/json")
+	_, _ = w.Write(jsonText)
+	_, _ = w.Write([]byte("\n"))
+}
@@ -641,6 +641,7 @@ func init() {
 	RegisterHandlerFnc("AppIcon", AppIcon)
 	RegisterHandlerFnc("JSON", JSON)
 	RegisterHandlerFnc("Submit", JSONSubmit)
+	RegisterHandlerFnc("JSONSchema", JSONSchema)
 	RegisterHandlerFnc("SchemaAPI", tools.SchemaAPI)
 	RegisterHandlerFnc("Entity", EntityPage)
 	RegisterHandlerFnc("Plain", PlainPage)
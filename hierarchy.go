@@ -0,0 +1,215 @@
+package grumble
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// -- H I E R A R C H I E S -------------------------------------------------
+
+// Node is an entity in a tree returned by Descendants, with the nodes of the
+// entity's children.
+type Node struct {
+	Entity   Persistable
+	Children []*Node
+}
+
+// Depth returns the number of keys in the chain of key, i.e. the number of
+// ancestors of key plus one. The zero key has depth 0.
+func (key *Key) Depth() (depth int) {
+	for k := key; k != nil && !k.IsZero(); k = k.Parent() {
+		depth++
+	}
+	return
+}
+
+// Ancestors returns the entities in the ancestor chain of the entity with
+// key, from the root down to its parent. The entity is read first, since key
+// may not hold its full chain, and the chain is read with one query per Kind.
+func (mgr *EntityManager) Ancestors(key *Key) (ret []Persistable, err error) {
+	e, err := mgr.GetByKey(key)
+	if err != nil {
+		return
+	}
+	if e == nil {
+		err = errors.New(fmt.Sprintf("entity %s does not exist", key))
+		return
+	}
+	keys := make([]*Key, 0)
+	for k := e.Parent(); k != nil && !k.IsZero(); k = k.Parent() {
+		keys = append([]*Key{k}, keys...)
+	}
+	if ret, err = mgr.GetMulti(keys); err != nil {
+		return
+	}
+	for ix, e := range ret {
+		if e == nil {
+			err = errors.New(fmt.Sprintf("ancestor %s of %s does not exist", keys[ix], key))
+			return
+		}
+	}
+	return
+}
+
+// Descendants returns the tree of entities below key, up to maxDepth levels
+// deep, or all levels if maxDepth is zero or less. The root node holds the
+// entity of key, or nil for the zero key, which has all root entities as
+// children. If kinds are given, only entities of these Kinds and Kinds
+// derived from them are returned, and entities below one that is not
+// returned are left out as well. Every Kind is read with one query, using
+// the index on _parent.
+func (mgr *EntityManager) Descendants(key *Key, maxDepth int, kinds ...interface{}) (root *Node, err error) {
+	if key == nil {
+		key = ZeroKey
+	}
+	root = &Node{}
+	if !key.IsZero() {
+		if root.Entity, err = mgr.GetByKey(key); err != nil {
+			return
+		}
+		if root.Entity == nil {
+			err = errors.New(fmt.Sprintf("entity %s does not exist", key))
+			return
+		}
+		key = root.Entity.AsKey()
+	}
+	queryKinds := make([]*Kind, 0)
+	withDerived := len(kinds) > 0
+	if withDerived {
+		for _, kind := range kinds {
+			var k *Kind
+			if k, err = KindOf(kind); err != nil {
+				return
+			}
+			queryKinds = append(queryKinds, k)
+		}
+	} else {
+		queryKinds = Kinds()
+		sort.Slice(queryKinds, func(i, j int) bool {
+			return queryKinds[i].Kind < queryKinds[j].Kind
+		})
+	}
+	depth := key.Depth()
+	entities := make([]Persistable, 0)
+	seen := make(map[string]bool)
+	for _, k := range queryKinds {
+		query := mgr.MakeQuery(k)
+		query.WithDerived = withDerived
+		query.AddCondition(&HasAncestor{Ancestor: key})
+		if maxDepth > 0 {
+			query.AddCondition(&HasMaxDepth{Depth: depth + maxDepth - 1})
+		}
+		query.AddReferenceJoins()
+		var results [][]Persistable
+		if results, err = query.Execute(); err != nil {
+			return
+		}
+		for _, row := range results {
+			if s := row[0].AsKey().String(); !seen[s] {
+				seen[s] = true
+				entities = append(entities, row[0])
+			}
+		}
+	}
+	sort.SliceStable(entities, func(i, j int) bool {
+		return entities[i].Parent().Depth() < entities[j].Parent().Depth()
+	})
+	nodes := map[string]*Node{key.String(): root}
+	for _, e := range entities {
+		parentKey := e.Parent()
+		if parentKey == nil {
+			parentKey = ZeroKey
+		}
+		parent, ok := nodes[parentKey.String()]
+		if !ok {
+			continue
+		}
+		node := &Node{Entity: e}
+		parent.Children = append(parent.Children, node)
+		nodes[e.AsKey().String()] = node
+	}
+	return
+}
+
+// isAncestor returns whether ancestor is key or one of the ancestors of key.
+func (key *Key) isAncestor(ancestor *Key) bool {
+	for k := key; k != nil && !k.IsZero(); k = k.Parent() {
+		if k.Kind().Kind == ancestor.Kind().Kind && k.Id() == ancestor.Id() {
+			return true
+		}
+	}
+	return false
+}
+
+// Move makes newParent the parent of e, which must have been stored. The
+// ancestor chains of e and of all its descendants, of any Kind, are
+// rewritten in one transaction. A nil newParent makes e a root entity.
+// Moving an entity below itself or one of its descendants is an error, as
+// is moving it below a parent of a Kind other than its ParentKind.
+func (mgr *EntityManager) Move(e Persistable, newParent Persistable) (err error) {
+	k := SetKind(e)
+	if k == nil {
+		_, err = KindOf(e)
+		return
+	}
+	if e.Id() <= 0 {
+		return errors.New(fmt.Sprintf("%s must be stored before it can be moved", k.Kind))
+	}
+	parentKey := ZeroKey
+	if newParent != nil && !newParent.AsKey().IsZero() {
+		// Read the parent to make sure its key has the full ancestor chain.
+		var p Persistable
+		if p, err = mgr.GetByKey(newParent.AsKey()); err != nil {
+			return
+		}
+		if p == nil {
+			return errors.New(fmt.Sprintf("parent %s does not exist", newParent.AsKey()))
+		}
+		parentKey = p.AsKey()
+	}
+	switch {
+	case k.ParentKind != nil && (parentKey.IsZero() || !parentKey.Kind().DerivesFrom(k.ParentKind)):
+		return errors.New(fmt.Sprintf("the parent of kind '%s' must be a '%s'", k.Kind, k.ParentKind.Kind))
+	case parentKey.isAncestor(e.AsKey()):
+		return errors.New(fmt.Sprintf("cannot move %s below itself", e.AsKey()))
+	}
+	key := e.AsKey()
+	err = mgr.Transaction(func(tx *sql.Tx) (err error) {
+		for _, kind := range Kinds() {
+			if kind.SingleTable && kind.BaseKind != nil {
+				continue
+			}
+			// Keep the chain up to and including e, and replace the rest
+			// with the new chain of its parent.
+			if _, err = tx.Exec(fmt.Sprintf(`UPDATE %s
+				SET "_parent" = "_parent"[1:array_position("_parent", $1::%q."Reference")] || $2::%q."Reference"[]
+				WHERE "_parent" @> ARRAY[$1::%q."Reference"]`, kind.QualifiedTableName(), mgr.Schema, mgr.Schema, mgr.Schema),
+				key.String(), parentKey.Chain()); err != nil {
+				return
+			}
+		}
+		// update() doesn't write _parent, so e itself is reparented here.
+		table := k
+		for table.SingleTable && table.BaseKind != nil {
+			table = table.BaseKind
+		}
+		_, err = tx.Exec(fmt.Sprintf(`UPDATE %s SET "_parent" = $1 WHERE "_id" = $2`, table.QualifiedTableName()),
+			parentKey.Chain(), e.Id())
+		return
+	})
+	if err != nil {
+		return
+	}
+	e.Initialize(parentKey, e.Id())
+	// Cached descendants still hold their old ancestor chain.
+	for _, entities := range mgr.cache.cache {
+		for id, cached := range entities {
+			if cached.Parent().isAncestor(key) {
+				delete(entities, id)
+			}
+		}
+	}
+	return
+}
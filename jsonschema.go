@@ -0,0 +1,351 @@
+package grumble
+
+import (
+	"encoding"
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// -- J S O N  S C H E M A --------------------------------------------------
+
+var jsonMarshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+var textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+
+// JSONSchema returns a JSON Schema (draft 2020-12) describing the JSON
+// representation of the entities of the Kind, as written and read by the
+// JSON handler. Referenced Kinds are described by a $ref to refPrefix
+// followed by the basename of the referenced Kind.
+func (k *Kind) JSONSchema(refPrefix string) (schema map[string]interface{}) {
+	properties := map[string]interface{}{
+		"Ident": map[string]interface{}{"type": "integer", "readOnly": true},
+		"_kind": map[string]interface{}{"const": k.Basename(), "readOnly": true},
+		"_key":  map[string]interface{}{"type": "string", "format": "grumble-key", "readOnly": true},
+	}
+	schema = map[string]interface{}{
+		"type":       "object",
+		"title":      k.VerboseName,
+		"x-kind":     k.Kind,
+		"properties": properties,
+	}
+	for _, column := range k.Columns {
+		path, ok := k.jsonPath(column.Index)
+		if !ok {
+			continue
+		}
+		obj := schema
+		for _, name := range path[:len(path)-1] {
+			props := obj["properties"].(map[string]interface{})
+			nested, ok := props[name].(map[string]interface{})
+			if !ok {
+				nested = map[string]interface{}{"type": "object", "properties": map[string]interface{}{}}
+				props[name] = nested
+			}
+			obj = nested
+		}
+		name := path[len(path)-1]
+		obj["properties"].(map[string]interface{})[name] = k.columnSchema(column, refPrefix)
+		if column.Required {
+			required, _ := obj["required"].([]string)
+			obj["required"] = append(required, name)
+		}
+	}
+	for _, link := range k.Links {
+		if path, ok := k.jsonPath(link.Index); ok {
+			properties[path[0]] = map[string]interface{}{
+				"type":  "array",
+				"title": link.VerboseName,
+				"items": map[string]interface{}{"$ref": refPrefix + link.References.Basename()},
+			}
+		}
+	}
+	for _, coll := range k.Children {
+		if path, ok := k.jsonPath(coll.Index); ok {
+			properties[path[0]] = map[string]interface{}{
+				"type":     "array",
+				"title":    coll.VerboseName,
+				"readOnly": true,
+				"items":    map[string]interface{}{"$ref": refPrefix + coll.Kind.Basename()},
+			}
+		}
+	}
+	for _, index := range k.Transient {
+		if path, ok := k.jsonPath(index); ok && len(path) == 1 {
+			properties[path[0]] = typeSchema(k.typ.FieldByIndex(index).Type, refPrefix, nil)
+		}
+	}
+	if k.Searchable() {
+		properties[RankField] = map[string]interface{}{"type": "number", "readOnly": true}
+	}
+	if k.ParentKind != nil {
+		properties[k.ParentKind.Basename()] = map[string]interface{}{
+			"$ref":     refPrefix + k.ParentKind.Basename(),
+			"readOnly": true,
+		}
+	}
+	return
+}
+
+// JSONSchemas returns the JSON Schemas of all registered Kinds, keyed by
+// the basenames of the Kinds.
+func JSONSchemas(refPrefix string) (schemas map[string]interface{}) {
+	schemas = make(map[string]interface{})
+	kinds := Kinds()
+	sort.Slice(kinds, func(i, j int) bool {
+		return kinds[i].Kind < kinds[j].Kind
+	})
+	for _, k := range kinds {
+		schemas[k.Basename()] = k.JSONSchema(refPrefix)
+	}
+	return
+}
+
+// jsonPath returns the names, as used by encoding/json, of the fields
+// leading to the field at index. Embedded structs without a json name don't
+// add to the path. ok is false if one of the fields is not marshalled.
+func (k *Kind) jsonPath(index []int) (path []string, ok bool) {
+	t := k.typ
+	for _, ix := range index {
+		for t.Kind() == reflect.Ptr {
+			t = t.Elem()
+		}
+		fld := t.Field(ix)
+		t = fld.Type
+		name, named := jsonName(fld)
+		if name == "-" {
+			return nil, false
+		}
+		if fld.Anonymous && !named {
+			continue
+		}
+		path = append(path, name)
+	}
+	return path, len(path) > 0
+}
+
+func jsonName(fld reflect.StructField) (name string, named bool) {
+	tag := fld.Tag.Get("json")
+	if tag == "-" {
+		return "-", true
+	}
+	if name = strings.Split(tag, ",")[0]; name != "" {
+		return name, true
+	}
+	return fld.Name, false
+}
+
+// columnSchema returns the JSON Schema of the values of column. The schema
+// follows the Go type of the column's field, since that determines how the
+// value is marshalled, and carries the column's SQL type, verbose name and
+// the constraints of its validation tags.
+func (k *Kind) columnSchema(column Column, refPrefix string) (schema map[string]interface{}) {
+	switch converter := column.Converter.(type) {
+	case *PolymorphicReferenceConverter:
+		refs := make([]interface{}, 0)
+		for _, allowed := range converter.Kinds() {
+			refs = append(refs, map[string]interface{}{"$ref": refPrefix + allowed.Basename()})
+		}
+		if len(refs) == 0 {
+			refs = append(refs, map[string]interface{}{"type": "object"})
+		}
+		schema = map[string]interface{}{"anyOf": append(refs, map[string]interface{}{"type": "null"})}
+	default:
+		schema = typeSchema(k.typ.FieldByIndex(column.Index).Type, refPrefix, nil)
+	}
+	schema["title"] = column.VerboseName
+	schema["x-sql-type"] = column.Converter.SQLType(column)
+	if column.Formula != "" {
+		schema["readOnly"] = true
+	}
+	if column.Tags != nil {
+		column.addConstraints(schema)
+	}
+	return
+}
+
+// addConstraints translates the validation tags of the column to JSON
+// Schema keywords. Like the validation itself, the length, pattern and
+// oneof constraints allow empty values unless the column is required.
+func (column Column) addConstraints(schema map[string]interface{}) {
+	tags := column.Tags
+	if hasType(schema, "integer") || hasType(schema, "number") {
+		if min, err := strconv.ParseFloat(tags.Get("min"), 64); err == nil {
+			schema["minimum"] = min
+		}
+		if max, err := strconv.ParseFloat(tags.Get("max"), 64); err == nil {
+			schema["maximum"] = max
+		}
+	}
+	minLen, minOk := tags.GetInt("minlen")
+	maxLen, maxOk := tags.GetInt("maxlen")
+	switch {
+	case hasType(schema, "string"):
+		if minOk && column.Required {
+			schema["minLength"] = minLen
+		}
+		if maxOk {
+			schema["maxLength"] = maxLen
+		}
+		if tags.Has("pattern") {
+			optional := "?"
+			if column.Required {
+				optional = ""
+			}
+			schema["pattern"] = "^(?:" + tags.Get("pattern") + ")" + optional + "$"
+		}
+	case hasType(schema, "array"):
+		if minOk && column.Required {
+			schema["minItems"] = minLen
+		}
+		if maxOk {
+			schema["maxItems"] = maxLen
+		}
+	}
+	if tags.Has("oneof") {
+		values := make([]interface{}, 0)
+		for _, option := range tags.GetStringList("oneof") {
+			option = strings.TrimSpace(option)
+			if hasType(schema, "integer") || hasType(schema, "number") {
+				if f, err := strconv.ParseFloat(option, 64); err == nil {
+					values = append(values, f)
+				}
+			} else {
+				values = append(values, option)
+			}
+		}
+		if hasType(schema, "string") && !column.Required {
+			values = append(values, "")
+		}
+		if hasType(schema, "null") {
+			values = append(values, nil)
+		}
+		schema["enum"] = values
+	}
+}
+
+func hasType(schema map[string]interface{}, jsonType string) bool {
+	switch t := schema["type"].(type) {
+	case string:
+		return t == jsonType
+	case []string:
+		for _, typ := range t {
+			if typ == jsonType {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func nullable(schema map[string]interface{}) map[string]interface{} {
+	switch t := schema["type"].(type) {
+	case string:
+		schema["type"] = []string{t, "null"}
+		if values, ok := schema["enum"].([]interface{}); ok {
+			schema["enum"] = append(values, nil)
+		}
+		return schema
+	case []string:
+		return schema
+	}
+	return map[string]interface{}{"anyOf": []interface{}{schema, map[string]interface{}{"type": "null"}}}
+}
+
+// typeSchema returns the JSON Schema for values of type t as marshalled by
+// encoding/json. Pointers to registered Kinds become a $ref to the Kind's
+// schema. seen guards against recursive struct types.
+func typeSchema(t reflect.Type, refPrefix string, seen map[reflect.Type]bool) (schema map[string]interface{}) {
+	switch {
+	case t == reflect.TypeOf(time.Time{}):
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case t == reflect.TypeOf(Decimal{}):
+		return map[string]interface{}{"type": "string", "format": "decimal"}
+	case t == reflect.TypeOf(EncodedKey{}):
+		return map[string]interface{}{"type": []string{"string", "null"}, "format": "grumble-key"}
+	case t == reflect.TypeOf(uuid.UUID{}):
+		return map[string]interface{}{"type": "string", "format": "uuid"}
+	case isEnum(t):
+		labels := reflect.Zero(t).Interface().(Enum).EnumValues()
+		values := make([]interface{}, 0, len(labels))
+		for _, label := range labels {
+			values = append(values, label)
+		}
+		if t.Kind() == reflect.String || t.Implements(jsonMarshalerType) || t.Implements(textMarshalerType) {
+			return map[string]interface{}{"type": "string", "enum": values}
+		}
+		return map[string]interface{}{"type": "integer", "minimum": 0, "maximum": len(labels) - 1, "x-enum-varnames": labels}
+	case t.Kind() == reflect.Ptr:
+		if k, ok := RegistryByType[t.Elem()]; ok {
+			return nullable(map[string]interface{}{"$ref": refPrefix + k.Basename()})
+		}
+		return nullable(typeSchema(t.Elem(), refPrefix, seen))
+	case t.Implements(jsonMarshalerType) || reflect.PtrTo(t).Implements(jsonMarshalerType):
+		return map[string]interface{}{}
+	case t.Implements(textMarshalerType) || reflect.PtrTo(t).Implements(textMarshalerType):
+		return map[string]interface{}{"type": "string"}
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		schema = map[string]interface{}{"type": "boolean"}
+	case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint8, reflect.Uint16:
+		schema = map[string]interface{}{"type": "integer", "format": "int32"}
+	case reflect.Int, reflect.Int64:
+		schema = map[string]interface{}{"type": "integer", "format": "int64"}
+	case reflect.Uint, reflect.Uint32, reflect.Uint64:
+		schema = map[string]interface{}{"type": "integer", "minimum": 0}
+	case reflect.Float32, reflect.Float64:
+		schema = map[string]interface{}{"type": "number"}
+	case reflect.String:
+		schema = map[string]interface{}{"type": "string"}
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.Uint8 {
+			schema = map[string]interface{}{"type": "string", "contentEncoding": "base64"}
+		} else {
+			schema = map[string]interface{}{"type": "array", "items": typeSchema(t.Elem(), refPrefix, seen)}
+		}
+	case reflect.Array:
+		schema = map[string]interface{}{
+			"type":     "array",
+			"items":    typeSchema(t.Elem(), refPrefix, seen),
+			"minItems": t.Len(),
+			"maxItems": t.Len(),
+		}
+	case reflect.Map:
+		schema = map[string]interface{}{"type": "object", "additionalProperties": typeSchema(t.Elem(), refPrefix, seen)}
+	case reflect.Struct:
+		if seen[t] {
+			return map[string]interface{}{"type": "object"}
+		}
+		if seen == nil {
+			seen = make(map[reflect.Type]bool)
+		}
+		seen[t] = true
+		defer delete(seen, t)
+		properties := make(map[string]interface{})
+		structProperties(t, refPrefix, seen, properties)
+		schema = map[string]interface{}{"type": "object", "properties": properties}
+	default:
+		schema = map[string]interface{}{}
+	}
+	return
+}
+
+func structProperties(t reflect.Type, refPrefix string, seen map[reflect.Type]bool, properties map[string]interface{}) {
+	for i := 0; i < t.NumField(); i++ {
+		fld := t.Field(i)
+		name, named := jsonName(fld)
+		switch {
+		case name == "-" || fld.PkgPath != "" && !fld.Anonymous:
+			continue
+		case fld.Anonymous && !named && fld.Type.Kind() == reflect.Struct:
+			structProperties(fld.Type, refPrefix, seen, properties)
+		default:
+			properties[name] = typeSchema(fld.Type, refPrefix, seen)
+		}
+	}
+}
@@ -1,10 +1,13 @@
 package grumble
 
 import (
+	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"strconv"
 	"strings"
+	"unicode/utf8"
 )
 
 type Key struct {
@@ -68,7 +71,12 @@ func buildKeyChain(chain []string) (ret *Key, err error) {
 	return
 }
 
+// ParseKey parses a key in the format returned by Key.String or Key.Chain,
+// or an encoded key as returned by Key.Encode.
 func ParseKey(key string) (*Key, error) {
+	if key = strings.TrimSpace(key); key != "" && !strings.ContainsAny(key, "{}(),\"") {
+		return DecodeKey(key)
+	}
 	r := strings.NewReplacer("{", "", "}", "", "(", "", ")", "", " ", "", "\"", "")
 	key = r.Replace(key)
 	if key == "" {
@@ -77,6 +85,47 @@ func ParseKey(key string) (*Key, error) {
 	return buildKeyChain(strings.Split(key, ","))
 }
 
+// DecodeKey returns the key encoded by Key.Encode.
+func DecodeKey(encoded string) (key *Key, err error) {
+	if encoded == "" {
+		return ZeroKey, nil
+	}
+	chain, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err == nil && !utf8.Valid(chain) {
+		err = errors.New("invalid UTF-8")
+	}
+	if err == nil {
+		key, err = buildKeyChain(strings.Split(string(chain), ","))
+	}
+	if err != nil {
+		err = errors.New(fmt.Sprintf("'%s' is not an encoded key: %s", encoded, err))
+	}
+	return
+}
+
+// ParseId returns the id in s, which is either an integer or an encoded key
+// of an entity of Kind k or of a Kind derived from it. If k is nil, keys of
+// any Kind are accepted.
+func ParseId(k *Kind, s string) (id int, err error) {
+	s = strings.TrimSpace(s)
+	if id64, e := strconv.ParseInt(s, 0, 0); e == nil {
+		return int(id64), nil
+	}
+	key, err := DecodeKey(s)
+	if err != nil {
+		return
+	}
+	switch {
+	case key.IsZero():
+		err = errors.New(fmt.Sprintf("'%s' is the zero key", s))
+	case k != nil && !key.Kind().DerivesFrom(k):
+		err = errors.New(fmt.Sprintf("'%s' is not the key of an entity of kind '%s'", s, k.Kind))
+	default:
+		id = key.Id()
+	}
+	return
+}
+
 // -- P E R S I S T A B L E  I M P L E M E N T A T I O N --------------------
 
 func (key *Key) Initialize(parent Persistable, id int) *Key {
@@ -190,6 +239,21 @@ func (key *Key) Chain() string {
 	return fmt.Sprintf("{%s}", strings.Join(keys, ","))
 }
 
+// Encode returns the key chain, from the key up to its root ancestor, as a
+// compact URL-safe string. Kinds are encoded by their basename unless that
+// is ambiguous. The zero key encodes as the empty string.
+func (key *Key) Encode() string {
+	chain := make([]string, 0)
+	for k := key; k != nil && !k.IsZero(); k = k.Parent() {
+		name := k.Kind().Basename()
+		if kindForBasename(name) != k.Kind() {
+			name = k.Kind().Kind
+		}
+		chain = append(chain, name, strconv.Itoa(k.Ident))
+	}
+	return base64.RawURLEncoding.EncodeToString([]byte(strings.Join(chain, ",")))
+}
+
 func (key *Key) SetManager(mgr *EntityManager) {
 	key.mgr = mgr
 }
@@ -200,3 +264,31 @@ func (key *Key) Manager() *EntityManager {
 	}
 	return key.mgr
 }
+
+// EncodedKey marshals a Key to JSON as the string returned by Key.Encode,
+// and unmarshals any format accepted by ParseKey. Key itself doesn't
+// implement json.Marshaler, since the method would be promoted to every
+// entity embedding it.
+type EncodedKey struct {
+	*Key
+}
+
+func (key EncodedKey) MarshalJSON() ([]byte, error) {
+	if key.Key == nil || key.IsZero() {
+		return []byte("null"), nil
+	}
+	return json.Marshal(key.Encode())
+}
+
+func (key *EncodedKey) UnmarshalJSON(data []byte) (err error) {
+	var s *string
+	if err = json.Unmarshal(data, &s); err != nil {
+		return
+	}
+	if s == nil {
+		key.Key = ZeroKey
+		return
+	}
+	key.Key, err = ParseKey(*s)
+	return
+}
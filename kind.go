@@ -1,27 +1,35 @@
 package grumble
 
 import (
+	"database/sql"
 	"errors"
 	"fmt"
 	"reflect"
 	"regexp"
+	"sort"
 	"strings"
+	"sync"
 	"unicode"
 	"unicode/utf8"
+
+	"github.com/lib/pq"
 )
 
 type Column struct {
-	Kind        *Kind
-	FieldName   string
-	Index       []int
-	ColumnName  string
-	Formula     string
-	VerboseName string
-	IsKey       bool
-	Scoped      bool
-	Required    bool
-	Converter   Converter
-	Tags        *Tags
+	Kind         *Kind
+	FieldName    string
+	Index        []int
+	ColumnName   string
+	Formula      string
+	VerboseName  string
+	IsKey        bool
+	Scoped       bool
+	Required     bool
+	Nullable     bool
+	SearchWeight string
+	RenamedFrom  []string
+	Converter    Converter
+	Tags         *Tags
 }
 
 type Kind struct {
@@ -37,6 +45,14 @@ type Kind struct {
 	baseIndex     int
 	derived       []*Kind
 	ParentKind    *Kind
+	BigSerial     bool
+	SingleTable   bool
+	SearchConfig  string
+	RenamedFrom   []string
+	NaturalKey    []string
+	ScopedKey     bool
+	Links         []*ManyToMany
+	Children      []*ChildCollection
 	Tags          *Tags
 	Transient     map[string][]int
 }
@@ -181,10 +197,114 @@ func Initialize(e Persistable, parent *Key, id int) Persistable {
 	return e
 }
 
+// KindOf returns the Kind of obj, like GetKind, but returns an error instead
+// of nil if obj is not of a registered Kind.
+func KindOf(obj interface{}) (kind *Kind, err error) {
+	if kind = GetKind(obj); kind == nil {
+		err = errors.New(fmt.Sprintf("'%v' (%T) is not of a registered kind", obj, obj))
+	}
+	return
+}
+
+// registry guards the state of the Kind registry. Once closed is set by
+// ReconcileAll, types are no longer registered implicitly when they are
+// first used, since their tables would not exist. Types passed to Register,
+// and the types they embed or refer to, are in allowed and can still be
+// created after that.
+var registry = struct {
+	sync.Mutex
+	closed  bool
+	allowed map[reflect.Type]bool
+}{allowed: make(map[reflect.Type]bool)}
+
+func mayCreateKind(t reflect.Type) bool {
+	registry.Lock()
+	defer registry.Unlock()
+	return !registry.closed || registry.allowed[t]
+}
+
+// reachableTypes adds t to types if it is a Persistable struct type, along
+// with the Persistable types its exported fields embed or refer to.
+func reachableTypes(t reflect.Type, types map[reflect.Type]bool) {
+	for t.Kind() == reflect.Ptr || t.Kind() == reflect.Slice || t.Kind() == reflect.Array || t.Kind() == reflect.Map {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct || types[t] {
+		return
+	}
+	p := reflect.TypeOf((*Persistable)(nil)).Elem()
+	if !t.Implements(p) && !reflect.PtrTo(t).Implements(p) {
+		return
+	}
+	types[t] = true
+	for i := 0; i < t.NumField(); i++ {
+		if fld := t.Field(i); fld.PkgPath == "" {
+			reachableTypes(fld.Type, types)
+		}
+	}
+}
+
+// Register creates the Kinds for the given Persistable types, and for the
+// Kinds they refer to or derive from. Types can be passed as values, pointers
+// or reflect.Types. Registering does not touch the database; the tables for
+// the registered Kinds are created by ReconcileAll.
+func Register(types ...interface{}) (err error) {
+	registered := make([]reflect.Type, 0, len(types))
+	reachable := make(map[reflect.Type]bool)
+	for _, typ := range types {
+		t, ok := typ.(reflect.Type)
+		if !ok {
+			t = reflect.TypeOf(typ)
+		}
+		if t == nil {
+			return errors.New("cannot register nil: it is not Persistable")
+		}
+		for t.Kind() == reflect.Ptr {
+			t = t.Elem()
+		}
+		reachableTypes(t, reachable)
+		registered = append(registered, t)
+	}
+	registry.Lock()
+	for t := range reachable {
+		registry.allowed[t] = true
+	}
+	registry.Unlock()
+	for _, t := range registered {
+		if getKindForType(t) == nil {
+			return errors.New(fmt.Sprintf("cannot register type '%s': it is not Persistable", t))
+		}
+	}
+	return
+}
+
+// ReconcileAll reconciles the Reference type and the tables of all
+// registered Kinds with the database. After ReconcileAll, types that were
+// not registered can not be used as Kinds anymore. Data migrations are
+// applied separately, by EntityManager.Migrate.
+func ReconcileAll(pg *PostgreSQLAdapter) (err error) {
+	if err = pg.ReconcileReferenceType(); err != nil {
+		return
+	}
+	kinds := Kinds()
+	sort.Slice(kinds, func(i, j int) bool {
+		return kinds[i].Kind < kinds[j].Kind
+	})
+	for _, k := range kinds {
+		if err = k.Reconcile(pg); err != nil {
+			return
+		}
+	}
+	registry.Lock()
+	registry.closed = true
+	registry.Unlock()
+	return
+}
+
 func getKindForType(t reflect.Type) *Kind {
 	var kind *Kind
 	kind, ok := RegistryByType[t]
-	if !ok {
+	if !ok && mayCreateKind(t) {
 		kind = createKind(t, nil)
 	}
 	return kind
@@ -195,17 +315,29 @@ func getKindForKind(k string) *Kind {
 	if kind, ok := RegistryByKind[k]; ok {
 		return kind
 	}
-	for _, kind := range RegistryByKind {
-		if kind.Basename() == k {
-			return kind
+	return kindForBasename(k)
+}
+
+// kindForBasename returns the Kind with basename name, or nil if there is
+// none or more than one, so that ambiguous names never resolve to whichever
+// Kind the map happens to yield first.
+func kindForBasename(name string) (ret *Kind) {
+	for _, kind := range RegistryByType {
+		if kind.Basename() == name {
+			if ret != nil {
+				return nil
+			}
+			ret = kind
 		}
 	}
-	return nil
+	return
 }
 
 var persistable reflect.Type = nil
 var typeAdapter reflect.Type = nil
 
+// Deprecated: DoReconcile is ignored. Kinds are no longer reconciled when
+// they are created; call ReconcileAll once all Kinds are registered.
 var DoReconcile = true
 
 func createKind(t reflect.Type, obj interface{}) *Kind {
@@ -231,6 +363,7 @@ func createKind(t reflect.Type, obj interface{}) *Kind {
 	kind.columnsByName = make(map[string]int)
 	kind.typ = t
 	kind.Transient = make(map[string][]int)
+	kind.ScopedKey = true
 	keyFound := false
 	RegistryByType[t] = kind
 	RegistryByKind[kind.Kind] = kind
@@ -266,13 +399,25 @@ func createKind(t reflect.Type, obj interface{}) *Kind {
 				continue
 			}
 		}
+		if children, _ := tags.GetBool("children"); children {
+			child := linkedKind(fld.Type)
+			if child == nil {
+				panic(fmt.Sprintf("Kind '%s': child collection '%s' must be a slice of pointers to entities",
+					kind.Kind, fld.Name))
+			}
+			kind.addChildCollection(fld, child, tags)
+			continue
+		}
+		if asJSON, _ := tags.GetBool("json"); !asJSON {
+			if references := linkedKind(fld.Type); references != nil {
+				kind.addLink(fld, references, tags)
+				continue
+			}
+		}
 		if converter := kind.GetConverter(fld, tags); converter != nil {
 			kind.CreateColumn(fld, converter, tags)
-		}
-	}
-	if DoReconcile {
-		if err := kind.Reconcile(nil); err != nil {
-			panic(err)
+		} else if fld.Type.Kind() == reflect.Struct {
+			kind.addValueColumns(fld, []int{i}, "", "", tags)
 		}
 	}
 	return kind
@@ -295,6 +440,26 @@ func (k *Kind) SetBaseKind(index int, base *Kind, tags *Tags) {
 	if k.ParentKind == nil {
 		k.ParentKind = base.ParentKind
 	}
+	if tags == nil || !tags.Has("bigserial") {
+		k.BigSerial = base.BigSerial
+	}
+	if k.SingleTable != base.SingleTable && tags != nil && tags.Has("singletable") {
+		panic(fmt.Sprintf("Kind '%s': single-table inheritance can only be set on the root of a hierarchy", k.Kind))
+	}
+	if k.SearchConfig == "" {
+		k.SearchConfig = base.SearchConfig
+	}
+	if base.SingleTable {
+		k.SingleTable = true
+		k.TableName = base.TableName
+		k.BigSerial = base.BigSerial
+	}
+	if len(k.NaturalKey) == 0 {
+		k.NaturalKey = append([]string(nil), base.NaturalKey...)
+		if tags == nil || !tags.Has("scoped") {
+			k.ScopedKey = base.ScopedKey
+		}
+	}
 	for _, column := range base.Columns {
 		derivedColumn := column
 		derivedColumn.Index = make([]int, 1)
@@ -308,6 +473,16 @@ func (k *Kind) SetBaseKind(index int, base *Kind, tags *Tags) {
 		ix = append(ix, baseIndex...)
 		k.Transient[n] = ix
 	}
+	for _, link := range base.Links {
+		derivedLink := *link
+		derivedLink.Index = append([]int{index}, link.Index...)
+		k.Links = append(k.Links, &derivedLink)
+	}
+	for _, coll := range base.Children {
+		derivedColl := *coll
+		derivedColl.Index = append([]int{index}, coll.Index...)
+		k.Children = append(k.Children, &derivedColl)
+	}
 }
 
 func (k *Kind) AddDerivedKind(derived *Kind) {
@@ -358,16 +533,51 @@ func (k *Kind) parseEntityTags(tags *Tags) {
 	if tags.Has("parentkind") {
 		k.ParentKind = getKindForKind(tags.Get("parentkind"))
 	}
+	if bigSerial, ok := tags.GetBool("bigserial"); ok {
+		k.BigSerial = bigSerial
+	}
+	if singleTable, ok := tags.GetBool("singletable"); ok {
+		k.SingleTable = singleTable
+	}
+	if tags.Has("naturalkey") {
+		k.NaturalKey = nil
+		for _, field := range tags.GetStringList("naturalkey") {
+			k.NaturalKey = append(k.NaturalKey, strings.TrimSpace(field))
+		}
+	}
+	if scoped, ok := tags.GetBool("scoped"); ok {
+		k.ScopedKey = scoped
+	}
+	if tags.Has("searchconfig") {
+		k.SearchConfig = tags.Get("searchconfig")
+	}
+	if tags.Has("renamedfrom") {
+		k.RenamedFrom = nil
+		for _, name := range tags.GetStringList("renamedfrom") {
+			k.RenamedFrom = append(k.RenamedFrom, strings.TrimSpace(name))
+		}
+		for _, previous := range k.previousKindNames() {
+			if _, ok := RegistryByKind[previous]; !ok {
+				RegistryByKind[previous] = k
+			}
+		}
+	}
 	k.Tags = tags
 }
 
 func (k *Kind) GetConverter(field reflect.StructField, tags *Tags) (converter Converter) {
 	taggedType := tags.Get("type")
+	asJSON, _ := tags.GetBool("json")
 	switch {
-	case field.Type.Kind() == reflect.Ptr && field.Type.Elem().Kind() == reflect.Struct:
-		structKind := getKindForType(field.Type.Elem())
-		if structKind != nil {
-			converter = &ReferenceConverter{References: structKind}
+	case asJSON:
+		converter = &JSONConverter{GoType: field.Type}
+	case field.Type.Kind() == reflect.Ptr && field.Type.Elem().Kind() == reflect.Struct &&
+		getKindForType(field.Type.Elem()) != nil:
+		converter = &ReferenceConverter{References: getKindForType(field.Type.Elem())}
+	case field.Type.Kind() == reflect.Interface && field.Type.Implements(persistable):
+		converter = &PolymorphicReferenceConverter{GoType: field.Type}
+		if tags.Has("polymorphic") {
+			converter.(*PolymorphicReferenceConverter).KindNames = tags.GetStringList("polymorphic")
 		}
 	case field.Type.Implements(typeAdapter):
 		instance := reflect.New(field.Type).Interface()
@@ -382,13 +592,16 @@ func (k *Kind) GetConverter(field reflect.StructField, tags *Tags) (converter Co
 }
 
 func (k *Kind) CreateColumn(field reflect.StructField, converter Converter, tags *Tags) {
+	k.createColumn(field, []int{field.Index[0]}, "", "", converter, tags)
+}
+
+func (k *Kind) createColumn(field reflect.StructField, index []int, fieldPrefix string, columnPrefix string,
+	converter Converter, tags *Tags) {
 	column := Column{}
-	column.FieldName = field.Name
+	column.FieldName = fieldPrefix + field.Name
 	column.IsKey = false
-	column.Index = make([]int, 1)
-	column.Index[0] = field.Index[0]
+	column.Index = index
 	column.Converter = converter
-	column.Required = true
 	column.Tags = tags
 	if v, ok := tags.GetBool("key"); ok && v {
 		column.IsKey = true
@@ -396,38 +609,127 @@ func (k *Kind) CreateColumn(field reflect.StructField, converter Converter, tags
 		if v, ok = tags.GetBool("scoped"); ok {
 			column.Scoped = v
 		}
+		k.NaturalKey = append(k.NaturalKey, column.FieldName)
+		k.ScopedKey = k.ScopedKey && column.Scoped
 	}
 	if v, ok := tags.GetBool("required"); ok {
 		column.Required = v
 	}
+	if tags.Has("pattern") {
+		if _, ok := tags.GetRegexp("pattern"); !ok {
+			panic(fmt.Sprintf("Kind '%s': invalid pattern %q for field '%s'", k.Kind, tags.Get("pattern"), column.FieldName))
+		}
+	}
+	if tags.Has("searchable") {
+		column.SearchWeight = "D"
+		if weight := strings.ToUpper(tags.Get("searchable")); weight != "TRUE" {
+			column.SearchWeight = weight
+		}
+		if !searchWeights[column.SearchWeight] {
+			panic(fmt.Sprintf("Kind '%s': invalid search weight %q for field '%s'", k.Kind, tags.Get("searchable"), column.FieldName))
+		}
+		t := field.Type
+		if t.Kind() == reflect.Ptr {
+			t = t.Elem()
+		}
+		if t.Kind() != reflect.String || isEnum(t) {
+			panic(fmt.Sprintf("Kind '%s': searchable field '%s' must be a string", k.Kind, column.FieldName))
+		}
+	}
+	column.Nullable = isNullable(converter)
+	if v, ok := tags.GetBool("nullable"); ok {
+		column.Nullable = v
+	}
 	if v, ok := tags.GetBool("label"); ok && v {
 		k.LabelCol = column.FieldName
 	}
 	if tags.Has("columnname") {
-		column.ColumnName = tags.Get("columnname")
+		column.ColumnName = columnPrefix + tags.Get("columnname")
 	} else {
-		column.ColumnName = column.FieldName
+		column.ColumnName = columnPrefix + field.Name
 	}
 	column.Formula = tags.Get("formula")
+	for _, name := range tags.GetStringList("renamedfrom") {
+		column.RenamedFrom = append(column.RenamedFrom, columnPrefix+strings.TrimSpace(name))
+	}
 	if tags.Has("verbosename") {
 		column.VerboseName = tags.Get("verbosename")
 	} else {
 		column.VerboseName = string(regexp.MustCompile("([[:lower:]])([[:upper:]])").ReplaceAll(
-			[]byte(strings.ReplaceAll(strings.Title(column.FieldName), "_", " ")),
+			[]byte(strings.NewReplacer("_", " ", ".", " ").Replace(strings.Title(column.FieldName))),
 			[]byte("$1 $2")))
 	}
 	column.Kind = k
 	k.addColumn(column)
 }
 
+// addValueColumns flattens the fields of a struct field that is not a Kind
+// into columns. The field names of these columns are the dotted paths to the
+// nested fields, and their column names are prefixed with the value of the
+// 'prefix' tag, which defaults to the name of the struct field followed by an
+// underscore.
+func (k *Kind) addValueColumns(field reflect.StructField, index []int, fieldPrefix string, columnPrefix string, tags *Tags) {
+	prefix := field.Name + "_"
+	if tags.Has("prefix") {
+		prefix = tags.Get("prefix")
+	}
+	fieldPrefix += field.Name + "."
+	columnPrefix += prefix
+	for i := 0; i < field.Type.NumField(); i++ {
+		fld := field.Type.Field(i)
+		r, _ := utf8.DecodeRuneInString(fld.Name)
+		if !unicode.IsUpper(r) {
+			continue
+		}
+		fldTags := ParseTags(fld.Tag.Get("grumble"))
+		if transient, _ := fldTags.GetBool("transient"); transient {
+			continue
+		}
+		fldIndex := append(append(make([]int, 0, len(index)+1), index...), i)
+		if converter := k.GetConverter(fld, fldTags); converter != nil {
+			k.createColumn(fld, fldIndex, fieldPrefix, columnPrefix, converter, fldTags)
+		} else if fld.Type.Kind() == reflect.Struct && GetKind(fld.Type) == nil {
+			k.addValueColumns(fld, fldIndex, fieldPrefix, columnPrefix, fldTags)
+		}
+	}
+}
+
 var _idColumn = SQLColumn{Name: "_id", SQLType: "serial", Default: "", Nullable: false, PrimaryKey: true, Unique: false, Indexed: false}
-var _parentColumn = SQLColumn{Name: "_parent", SQLType: "", Default: "", Nullable: true, PrimaryKey: false, Unique: false, Indexed: false}
+var _parentColumn = SQLColumn{Name: "_parent", SQLType: "", Default: "", Nullable: true, PrimaryKey: false, Unique: false, Indexed: true, IndexMethod: "gin"}
 var _parentIndex = SQLIndex{Columns: []string{"_parent", "_id"}, PrimaryKey: false, Unique: true}
+var _kindColumn = SQLColumn{Name: "_kind", SQLType: "text", Default: "", Nullable: false, PrimaryKey: false, Unique: false, Indexed: true}
+var _searchColumn = SQLColumn{Name: "_search", SQLType: "tsvector", Default: "", Nullable: true, PrimaryKey: false, Unique: false, Indexed: true, IndexMethod: "gin"}
 
 func (k *Kind) Reconcile(pg *PostgreSQLAdapter) (err error) {
+	if k.SingleTable && k.BaseKind != nil {
+		if err = k.renameReferences(pg); err != nil {
+			return
+		}
+		return k.reconcileLinks(pg)
+	}
+	columns := k.Columns
+	if k.SingleTable {
+		if columns, err = k.singleTableColumns(); err != nil {
+			return
+		}
+	}
 	table := k.SQLTable(pg)
+	for _, col := range columns {
+		if enum, ok := col.Converter.(*EnumConverter); ok {
+			if err = table.pg.ReconcileEnum(enum.TypeName, enum.Values); err != nil {
+				return
+			}
+		}
+	}
 	if table.GetColumnByName(_idColumn.Name) == nil {
-		if err = table.AddColumn(_idColumn); err != nil {
+		if !k.SingleTable || k.BaseKind == nil {
+			table.RenamedFrom = k.previousTableNames()
+		}
+		idColumn := _idColumn
+		if k.BigSerial {
+			idColumn.SQLType = "bigserial"
+		}
+		if err = table.AddColumn(idColumn); err != nil {
 			return
 		}
 		if _parentColumn.SQLType == "" {
@@ -439,31 +741,202 @@ func (k *Kind) Reconcile(pg *PostgreSQLAdapter) (err error) {
 		if err = table.AddIndex(_parentIndex); err != nil {
 			return
 		}
-		for _, col := range k.Columns {
+		if k.SingleTable {
+			if err = table.AddColumn(_kindColumn); err != nil {
+				return
+			}
+		}
+		for _, col := range columns {
 			if col.Formula == "" {
 				c := SQLColumn{}
 				c.Name = col.ColumnName
 				c.SQLType = col.Converter.SQLType(col)
+				c.Nullable = col.Nullable
+				c.RenamedFrom = col.RenamedFrom
+				if col.Tags.Has("index") {
+					if indexed, ok := col.Tags.GetBool("index"); ok {
+						c.Indexed = indexed
+					} else {
+						c.Indexed = true
+						c.IndexMethod = col.Tags.Get("index")
+					}
+				}
 				if err = table.AddColumn(c); err != nil {
 					return
 				}
-				if col.IsKey {
-					keyCols := make([]string, 2)
-					if col.Scoped {
-						keyCols = append(keyCols, "_parent")
-					}
-					keyCols = append(keyCols, col.ColumnName)
-					index := SQLIndex{Columns: keyCols, PrimaryKey: false, Unique: true}
-					if err = table.AddIndex(index); err != nil {
-						return
-					}
-				}
+			}
+		}
+		if search, ok := k.searchColumn(columns); ok {
+			if err = table.AddColumn(search); err != nil {
+				return
+			}
+		}
+		if len(k.NaturalKey) > 0 {
+			var keyCols []string
+			if keyCols, err = k.NaturalKeyIndexColumns(); err != nil {
+				return
+			}
+			index := SQLIndex{Columns: keyCols, PrimaryKey: false, Unique: true}
+			if err = table.AddIndex(index); err != nil {
+				return
 			}
 		}
 	}
 	if err = table.Reconcile(); err != nil {
 		return
 	}
+	if k.SingleTable {
+		if err = k.renameKindValues(table); err != nil {
+			return
+		}
+	}
+	if err = k.renameReferences(pg); err != nil {
+		return
+	}
+	return k.reconcileLinks(pg)
+}
+
+// previousKindNames returns the names the Kind had under the type names in
+// its renamedfrom tag. These names are registered as aliases of the Kind,
+// so that keys stored under the old name still resolve.
+func (k *Kind) previousKindNames() (names []string) {
+	prefix := strings.TrimSuffix(k.Kind, k.Basename())
+	for _, name := range k.RenamedFrom {
+		names = append(names, prefix+strings.ToLower(name))
+	}
+	return
+}
+
+// previousTableNames returns the default table names of the type names in
+// the renamedfrom tag of the Kind.
+func (k *Kind) previousTableNames() (names []string) {
+	for _, name := range k.RenamedFrom {
+		if name = strings.ToLower(name); name != k.TableName {
+			names = append(names, name)
+		}
+	}
+	return
+}
+
+// renameKindValues replaces the previous names of the Kinds sharing a single
+// table in its _kind column.
+func (k *Kind) renameKindValues(table *SQLTable) (err error) {
+	return table.pg.TX(func(conn *sql.DB) (err error) {
+		for _, kind := range append([]*Kind{k}, k.DerivedKinds()...) {
+			for _, previous := range kind.previousKindNames() {
+				if _, err = conn.Exec(fmt.Sprintf(`UPDATE %s SET "_kind" = $1 WHERE "_kind" = $2`,
+					table.QualifiedName()), kind.Kind, previous); err != nil {
+					return
+				}
+			}
+		}
+		return
+	})
+}
+
+// renameReferences replaces the previous names of the Kind in all Reference
+// values in the schema: reference and polymorphic reference columns, the
+// _parent chains, and the _owner and _target columns of join tables.
+func (k *Kind) renameReferences(pg *PostgreSQLAdapter) (err error) {
+	previous := k.previousKindNames()
+	if len(previous) == 0 {
+		return
+	}
+	return pg.TX(func(conn *sql.DB) (err error) {
+		columns, err := pg.referenceColumns(conn)
+		if err != nil {
+			return
+		}
+		reference := fmt.Sprintf("%q.\"Reference\"", pg.GetSchema())
+		for _, column := range columns {
+			var update string
+			if column.array {
+				update = fmt.Sprintf(`UPDATE %q.%q SET %[3]q = ARRAY(
+						SELECT (CASE WHEN u."kind" = ANY($2) THEN $1 ELSE u."kind" END, u."id")::%[4]s
+						FROM unnest(%[3]q) WITH ORDINALITY AS u("kind", "id", "n") ORDER BY u."n")
+					WHERE EXISTS (SELECT 1 FROM unnest(%[3]q) AS u("kind", "id") WHERE u."kind" = ANY($2))`,
+					pg.GetSchema(), column.table, column.column, reference)
+			} else {
+				update = fmt.Sprintf(`UPDATE %q.%q SET %[3]q = ($1::text, (%[3]q)."id")::%[4]s WHERE (%[3]q)."kind" = ANY($2)`,
+					pg.GetSchema(), column.table, column.column, reference)
+			}
+			if _, err = conn.Exec(update, k.Kind, pq.Array(previous)); err != nil {
+				return
+			}
+		}
+		return
+	})
+}
+
+func (k *Kind) reconcileLinks(pg *PostgreSQLAdapter) (err error) {
+	for _, link := range k.Links {
+		if link.Owner == k {
+			if err = link.Reconcile(pg); err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+// singleTableColumns returns the columns of the table shared by k and the
+// Kinds derived from it. Columns that not all of these Kinds have are made
+// nullable.
+func (k *Kind) singleTableColumns() (columns []Column, err error) {
+	columns = append([]Column(nil), k.Columns...)
+	byName := make(map[string]Column)
+	for _, col := range k.Columns {
+		byName[col.ColumnName] = col
+	}
+	for _, derived := range k.DerivedKinds() {
+		for _, col := range derived.Columns {
+			if existing, ok := byName[col.ColumnName]; ok {
+				if existing.Converter.SQLType(existing) != col.Converter.SQLType(col) {
+					err = errors.New(fmt.Sprintf("kinds '%s' and '%s' both have a column '%s' with different types",
+						existing.Kind.Kind, col.Kind.Kind, col.ColumnName))
+					return
+				}
+				continue
+			}
+			col.Nullable = true
+			byName[col.ColumnName] = col
+			columns = append(columns, col)
+		}
+	}
+	return
+}
+
+// NaturalKeyColumns returns the columns that make up the natural key of the
+// Kind, in key order.
+func (k *Kind) NaturalKeyColumns() (columns []Column, err error) {
+	for _, name := range k.NaturalKey {
+		column, ok := k.Column(name)
+		if !ok {
+			err = errors.New(fmt.Sprintf("natural key of kind '%s' refers to unknown field '%s'", k.Kind, name))
+			return
+		}
+		if column.Formula != "" {
+			err = errors.New(fmt.Sprintf("natural key of kind '%s' cannot use formula field '%s'", k.Kind, name))
+			return
+		}
+		columns = append(columns, column)
+	}
+	return
+}
+
+// NaturalKeyIndexColumns returns the names of the columns of the unique index
+// enforcing the natural key. For scoped keys this includes "_parent".
+func (k *Kind) NaturalKeyIndexColumns() (names []string, err error) {
+	columns, err := k.NaturalKeyColumns()
+	if err != nil {
+		return
+	}
+	if k.ScopedKey {
+		names = append(names, "_parent")
+	}
+	for _, column := range columns {
+		names = append(names, column.ColumnName)
+	}
 	return
 }
 
@@ -0,0 +1,387 @@
+package grumble
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// -- M A N Y - T O - M A N Y -----------------------------------------------
+
+// ManyToMany describes a field holding a slice of pointers to entities of
+// another Kind, like Tags []*Tag. The references are stored in a join table
+// with one row per element, in slice order. The table is named after the
+// table of the declaring Kind and the field, unless the field has a
+// jointable tag. Kinds derived from the declaring Kind share its join table.
+type ManyToMany struct {
+	FieldName   string
+	Index       []int
+	Owner       *Kind
+	References  *Kind
+	VerboseName string
+	Tags        *Tags
+}
+
+func linkedKind(t reflect.Type) *Kind {
+	if t.Kind() != reflect.Slice || t.Elem().Kind() != reflect.Ptr || t.Elem().Elem().Kind() != reflect.Struct {
+		return nil
+	}
+	return getKindForType(t.Elem().Elem())
+}
+
+func (k *Kind) addLink(field reflect.StructField, references *Kind, tags *Tags) {
+	if _, ok := k.Link(field.Name); ok {
+		panic(fmt.Sprintf("Kind '%s' cannot have two links with the same name '%s'", k.Kind, field.Name))
+	}
+	link := &ManyToMany{
+		FieldName:   field.Name,
+		Index:       []int{field.Index[0]},
+		Owner:       k,
+		References:  references,
+		VerboseName: field.Name,
+		Tags:        tags,
+	}
+	if tags.Has("verbosename") {
+		link.VerboseName = tags.Get("verbosename")
+	}
+	k.Links = append(k.Links, link)
+}
+
+// Link returns the many-to-many relation stored in the field with the given
+// name.
+func (k *Kind) Link(fieldName string) (link *ManyToMany, ok bool) {
+	for _, l := range k.Links {
+		if l.FieldName == fieldName {
+			return l, true
+		}
+	}
+	return
+}
+
+func (link *ManyToMany) TableName() string {
+	if link.Tags.Has("jointable") {
+		return link.Tags.Get("jointable")
+	}
+	return link.Owner.TableName + "_" + strings.ToLower(link.FieldName)
+}
+
+// previousTableNames returns the default join table names the relation had
+// under the previous table names of its owner and the field names in the
+// renamedfrom tag of the link.
+func (link *ManyToMany) previousTableNames() (names []string) {
+	if link.Tags.Has("jointable") {
+		return
+	}
+	owners := append([]string{link.Owner.TableName}, link.Owner.previousTableNames()...)
+	fields := []string{strings.ToLower(link.FieldName)}
+	if link.Tags.Has("renamedfrom") {
+		for _, name := range link.Tags.GetStringList("renamedfrom") {
+			fields = append(fields, strings.ToLower(strings.TrimSpace(name)))
+		}
+	}
+	current := link.TableName()
+	for _, owner := range owners {
+		for _, field := range fields {
+			if name := owner + "_" + field; name != current {
+				names = append(names, name)
+			}
+		}
+	}
+	return
+}
+
+func (link *ManyToMany) SQLTable(pg *PostgreSQLAdapter) SQLTable {
+	if pg == nil {
+		pg = GetPostgreSQLAdapter()
+	}
+	return pg.makeTable(link.TableName())
+}
+
+func (link *ManyToMany) QualifiedTableName() string {
+	table := link.SQLTable(nil)
+	return table.QualifiedName()
+}
+
+// Reconcile creates or updates the join table of the relation. The _owner
+// and _target columns hold the keys of the owning and the referenced entity,
+// _position the index of the reference in the slice.
+func (link *ManyToMany) Reconcile(pg *PostgreSQLAdapter) (err error) {
+	table := link.SQLTable(pg)
+	table.RenamedFrom = link.previousTableNames()
+	reference := fmt.Sprintf("%q.\"Reference\"", table.pg.Schema)
+	columns := []SQLColumn{
+		{Name: "_owner", SQLType: reference},
+		{Name: "_target", SQLType: reference, Indexed: true},
+		{Name: "_position", SQLType: "integer"},
+	}
+	for _, column := range columns {
+		if err = table.AddColumn(column); err != nil {
+			return
+		}
+	}
+	if err = table.AddIndex(SQLIndex{Columns: []string{"_owner", "_position"}, Unique: true}); err != nil {
+		return
+	}
+	return table.Reconcile()
+}
+
+// targets returns the keys of the entities in the slice fld, skipping nil
+// elements. All entities must have been stored before.
+func (link *ManyToMany) targets(fld reflect.Value) (keys []string, err error) {
+	keys = make([]string, 0, fld.Len())
+	for ix := 0; ix < fld.Len(); ix++ {
+		elem := fld.Index(ix)
+		if elem.IsNil() {
+			continue
+		}
+		target := elem.Interface().(Persistable)
+		if target.Id() <= 0 {
+			err = errors.New(fmt.Sprintf("%s[%d] must be stored before it can be referenced", link.FieldName, ix))
+			return
+		}
+		keys = append(keys, target.AsKey().String())
+	}
+	return
+}
+
+// SetValue assigns value to the relation's field of e. value can be a slice
+// of the field's type, a []*Key, a []Persistable, or a []string or
+// []interface{} holding entity keys or ids of the referenced Kind, as
+// submitted by forms and JSON requests. A string is either a single key in
+// (kind,id) form, or a comma separated list of ids or encoded keys.
+// Entities given by key or id are read using the manager of e.
+func (link *ManyToMany) SetValue(e Persistable, value interface{}) (err error) {
+	fld := reflect.ValueOf(e).Elem().FieldByIndex(link.Index)
+	if value == nil {
+		fld.Set(reflect.Zero(fld.Type()))
+		return
+	}
+	if v := reflect.ValueOf(value); v.Type().AssignableTo(fld.Type()) {
+		fld.Set(v)
+		return
+	}
+	targets := make([]Persistable, 0)
+	switch v := value.(type) {
+	case []Persistable:
+		targets = v
+	case []*Key:
+		for _, key := range v {
+			var target Persistable
+			if target, err = e.Manager().Get(key.Kind(), key.Id()); err != nil {
+				return
+			}
+			targets = append(targets, target)
+		}
+	case string:
+		if strings.HasPrefix(strings.TrimSpace(v), "(") {
+			// Keys in (kind,id) form contain commas themselves.
+			return link.SetValue(e, []string{v})
+		}
+		return link.SetValue(e, strings.Split(v, ","))
+	case []interface{}:
+		keys := make([]string, 0, len(v))
+		for _, elem := range v {
+			keys = append(keys, fmt.Sprintf("%v", elem))
+		}
+		return link.SetValue(e, keys)
+	case []string:
+		for _, s := range v {
+			if s = strings.TrimSpace(s); s == "" {
+				continue
+			}
+			var target Persistable
+			if target, err = link.lookup(e.Manager(), s); err != nil {
+				return
+			}
+			targets = append(targets, target)
+		}
+	default:
+		err = errors.New(fmt.Sprintf("cannot assign %v (%T) to %s", value, value, link.FieldName))
+		return
+	}
+	return link.set(fld, targets)
+}
+
+func (link *ManyToMany) lookup(mgr *EntityManager, s string) (target Persistable, err error) {
+	if id, e := strconv.Atoi(s); e == nil {
+		return mgr.Get(link.References, id)
+	}
+	key, err := ParseKey(s)
+	if err != nil {
+		return
+	}
+	if key.IsZero() {
+		err = errors.New(fmt.Sprintf("cannot reference zero key in %s", link.FieldName))
+		return
+	}
+	return mgr.Get(key.Kind(), key.Id())
+}
+
+func (link *ManyToMany) set(fld reflect.Value, targets []Persistable) (err error) {
+	slice := reflect.MakeSlice(fld.Type(), 0, len(targets))
+	for _, target := range targets {
+		if target == nil {
+			continue
+		}
+		if !target.Kind().DerivesFrom(link.References) {
+			err = errors.New(fmt.Sprintf("cannot add entity of kind '%s' to %s: kind does not derive from '%s'",
+				target.Kind().Kind, link.FieldName, link.References.Kind))
+			return
+		}
+		slice = reflect.Append(slice, reflect.ValueOf(CastTo(target, link.References)))
+	}
+	fld.Set(slice)
+	return
+}
+
+// syncLinks replaces the rows in the join tables of e by the entities
+// currently in its relation fields.
+func (mgr *EntityManager) syncLinks(e Persistable, conn *sql.DB) (err error) {
+	v := reflect.ValueOf(e).Elem()
+	owner := e.AsKey().String()
+	for _, link := range e.Kind().Links {
+		var targets []string
+		if targets, err = link.targets(v.FieldByIndex(link.Index)); err != nil {
+			return
+		}
+		table := link.QualifiedTableName()
+		if _, err = conn.Exec(fmt.Sprintf(`DELETE FROM %s WHERE "_owner" = $1::%q."Reference"`,
+			table, mgr.Schema), owner); err != nil {
+			return
+		}
+		if len(targets) == 0 {
+			continue
+		}
+		if _, err = conn.Exec(fmt.Sprintf(`INSERT INTO %s ( "_owner", "_target", "_position" )
+				SELECT $1::%q."Reference", t."target", t."position"
+				FROM unnest($2::%q."Reference"[]) WITH ORDINALITY AS t("target", "position")`,
+			table, mgr.Schema, mgr.Schema), owner, pq.Array(targets)); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// deleteLinks removes the rows in the join tables of e.
+func (mgr *EntityManager) deleteLinks(e Persistable, conn *sql.DB) (err error) {
+	for _, link := range e.Kind().Links {
+		if _, err = conn.Exec(fmt.Sprintf(`DELETE FROM %s WHERE "_owner" = $1::%q."Reference"`,
+			link.QualifiedTableName(), mgr.Schema), e.AsKey().String()); err != nil {
+			return
+		}
+	}
+	return
+}
+
+type linkOwner struct {
+	e    Persistable
+	link *ManyToMany
+}
+
+// loadLinks fills the relation fields of the entities in rows. It reads each
+// join table once and the referenced entities once per Kind, no matter how
+// many rows there are. Referenced entities that don't exist anymore are
+// left out. The relations of the referenced entities are not loaded.
+func (mgr *EntityManager) loadLinks(rows [][]Persistable) (err error) {
+	owners := make(map[string][]linkOwner)
+	for _, row := range rows {
+		for _, e := range row {
+			if e == nil || e.Kind() == nil || e.Id() <= 0 {
+				continue
+			}
+			for _, link := range e.Kind().Links {
+				owners[link.TableName()] = append(owners[link.TableName()], linkOwner{e, link})
+			}
+		}
+	}
+	if len(owners) == 0 {
+		return
+	}
+	targetsOf := make(map[string][]string)
+	ids := make(map[string][]int)
+	err = mgr.TX(func(conn *sql.DB) (err error) {
+		for table, tableOwners := range owners {
+			keys := make([]string, 0, len(tableOwners))
+			for _, o := range tableOwners {
+				keys = append(keys, o.e.AsKey().String())
+			}
+			rows, err := conn.Query(fmt.Sprintf(`SELECT ("_owner")."kind", ("_owner")."id", ("_target")."kind", ("_target")."id"
+					FROM %s WHERE "_owner" = ANY($1::%q."Reference"[]) ORDER BY "_position"`,
+				tableOwners[0].link.QualifiedTableName(), mgr.Schema), pq.Array(keys))
+			if err != nil {
+				return err
+			}
+			for rows.Next() {
+				var ownerKind, targetKind string
+				var ownerId, targetId int
+				if err = rows.Scan(&ownerKind, &ownerId, &targetKind, &targetId); err != nil {
+					_ = rows.Close()
+					return err
+				}
+				owner := fmt.Sprintf("%s(%s,%d)", table, ownerKind, ownerId)
+				targetsOf[owner] = append(targetsOf[owner], fmt.Sprintf("(%s,%d)", targetKind, targetId))
+				ids[targetKind] = append(ids[targetKind], targetId)
+			}
+			if err = rows.Close(); err != nil {
+				return err
+			}
+			if err = rows.Err(); err != nil {
+				return err
+			}
+		}
+		return
+	})
+	if err != nil {
+		return
+	}
+	targets := make(map[string]Persistable)
+	for kindName, kindIds := range ids {
+		k := GetKind(kindName)
+		if k == nil {
+			err = errors.New(fmt.Sprintf("unknown kind '%s' in join table", kindName))
+			return
+		}
+		fetch := make([]int, 0, len(kindIds))
+		for _, id := range kindIds {
+			if mgr.cache.Has(k, id) {
+				target := mgr.cache.Get(k, id)
+				targets[target.AsKey().String()] = target
+			} else {
+				fetch = append(fetch, id)
+			}
+		}
+		if len(fetch) == 0 {
+			continue
+		}
+		query := mgr.MakeQuery(k)
+		query.AddCondition(&HasIds{Ids: fetch})
+		query.shallow = true
+		var results [][]Persistable
+		if results, err = query.Execute(); err != nil {
+			return
+		}
+		for _, row := range results {
+			targets[row[0].AsKey().String()] = row[0]
+		}
+	}
+	for table, tableOwners := range owners {
+		for _, o := range tableOwners {
+			linked := make([]Persistable, 0)
+			for _, key := range targetsOf[table+o.e.AsKey().String()] {
+				if target, ok := targets[key]; ok {
+					linked = append(linked, target)
+				}
+			}
+			fld := reflect.ValueOf(o.e).Elem().FieldByIndex(o.link.Index)
+			if err = o.link.set(fld, linked); err != nil {
+				return
+			}
+		}
+	}
+	return
+}
@@ -0,0 +1,248 @@
+package grumble
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// -- M I G R A T I O N S ---------------------------------------------------
+
+// MigrationTable is the name of the table recording the applied migrations.
+const MigrationTable = "_migrations"
+
+// MigrationFunc performs a data migration. It is called inside the
+// transaction of the migration, and must run its statements on tx for them
+// to be rolled back if the migration fails.
+type MigrationFunc func(mgr *EntityManager, tx *sql.Tx) error
+
+// Migration is a numbered data migration of a Kind, or of the application
+// if Kind is nil. It is either a Go function or a SQL file. SQL files are
+// executed as a template with the PostgreSQLAdapter as data, like the
+// SchemaInit file.
+type Migration struct {
+	Kind    *Kind
+	Version int
+	Name    string
+	Func    MigrationFunc
+	SQLFile string
+}
+
+// MigrationStatus is a registered migration, and when it was applied.
+type MigrationStatus struct {
+	*Migration
+	Applied   bool
+	AppliedAt time.Time
+}
+
+var migrations = make(map[string][]*Migration)
+
+var migrationFileName = regexp.MustCompile(`^(\d+)_(.+)\.sql$`)
+
+// Scope returns the name of the Kind of the migration, or the empty string
+// for migrations of the application.
+func (migration *Migration) Scope() string {
+	if migration.Kind == nil {
+		return ""
+	}
+	return migration.Kind.Kind
+}
+
+func (migration *Migration) String() string {
+	scope := migration.Scope()
+	if scope == "" {
+		scope = "application"
+	}
+	return fmt.Sprintf("%s #%d %q", scope, migration.Version, migration.Name)
+}
+
+func registerMigration(kind interface{}, migration *Migration) (err error) {
+	if kind != nil {
+		if migration.Kind, err = KindOf(kind); err != nil {
+			return
+		}
+	}
+	if migration.Version <= 0 {
+		return errors.New(fmt.Sprintf("migration %s: version must be positive", migration))
+	}
+	scope := migration.Scope()
+	for _, registered := range migrations[scope] {
+		if registered.Version == migration.Version {
+			return errors.New(fmt.Sprintf("migration %s: version is already used by %s", migration, registered))
+		}
+	}
+	registered := append(migrations[scope], migration)
+	sort.Slice(registered, func(i, j int) bool {
+		return registered[i].Version < registered[j].Version
+	})
+	migrations[scope] = registered
+	return
+}
+
+// RegisterMigration registers a Go function as migration version of the
+// Kind of kind, or of the application if kind is nil.
+func RegisterMigration(kind interface{}, version int, name string, fnc MigrationFunc) error {
+	return registerMigration(kind, &Migration{Version: version, Name: name, Func: fnc})
+}
+
+// RegisterSQLMigration registers a SQL file as migration version of the
+// Kind of kind, or of the application if kind is nil.
+func RegisterSQLMigration(kind interface{}, version int, name string, sqlFile string) error {
+	return registerMigration(kind, &Migration{Version: version, Name: name, SQLFile: sqlFile})
+}
+
+// RegisterMigrationDir registers the files in dir named like
+// 0003_split_name.sql as SQL migrations. The number is the version of the
+// migration, the rest of the file name its name.
+func RegisterMigrationDir(kind interface{}, dir string) (err error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, file := range files {
+		match := migrationFileName.FindStringSubmatch(file.Name())
+		if file.IsDir() || match == nil {
+			continue
+		}
+		version, _ := strconv.Atoi(match[1])
+		if err = RegisterSQLMigration(kind, version, match[2], filepath.Join(dir, file.Name())); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// Migrations returns the registered migrations in the order they are
+// applied: the migrations of the Kinds, sorted by Kind name, followed by the
+// migrations of the application. Migrations of the same Kind are applied in
+// version order.
+func Migrations() (ret []*Migration) {
+	scopes := make([]string, 0)
+	for scope := range migrations {
+		if scope != "" {
+			scopes = append(scopes, scope)
+		}
+	}
+	sort.Strings(scopes)
+	for _, scope := range append(scopes, "") {
+		ret = append(ret, migrations[scope]...)
+	}
+	return
+}
+
+func (pg *PostgreSQLAdapter) reconcileMigrationTable() (err error) {
+	table := pg.makeTable(MigrationTable)
+	for _, column := range []SQLColumn{
+		{Name: "scope", SQLType: "text"},
+		{Name: "version", SQLType: "integer"},
+		{Name: "name", SQLType: "text"},
+		{Name: "applied", SQLType: "timestamp with time zone"},
+	} {
+		if err = table.AddColumn(column); err != nil {
+			return
+		}
+	}
+	if err = table.AddIndex(SQLIndex{Columns: []string{"scope", "version"}, Unique: true}); err != nil {
+		return
+	}
+	return table.Reconcile()
+}
+
+// migrationScope maps a scope recorded in the migration table to the current
+// scope, so that migrations of a Kind recorded under one of its previous
+// names are not applied again.
+func migrationScope(scope string) string {
+	if k, ok := RegistryByKind[scope]; ok {
+		return k.Kind
+	}
+	return scope
+}
+
+// MigrationStatus returns the registered migrations in the order they are
+// applied, with the time they were applied if they were. If the migration
+// table does not exist yet, no migration has been applied.
+func (mgr *EntityManager) MigrationStatus() (status []MigrationStatus, err error) {
+	applied := make(map[string]time.Time)
+	err = mgr.TX(func(db *sql.DB) (err error) {
+		if exists, err := mgr.makeTable(MigrationTable).exists(db); err != nil || !exists {
+			return err
+		}
+		rows, err := db.Query(fmt.Sprintf("SELECT \"scope\", \"version\", \"applied\" FROM %q.%q",
+			mgr.Schema, MigrationTable))
+		if err != nil {
+			return
+		}
+		defer func() {
+			_ = rows.Close()
+		}()
+		for rows.Next() {
+			var scope string
+			var version int
+			var at time.Time
+			if err = rows.Scan(&scope, &version, &at); err != nil {
+				return
+			}
+			applied[fmt.Sprintf("%s#%d", migrationScope(scope), version)] = at
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return
+	}
+	for _, migration := range Migrations() {
+		s := MigrationStatus{Migration: migration}
+		s.AppliedAt, s.Applied = applied[fmt.Sprintf("%s#%d", migration.Scope(), migration.Version)]
+		status = append(status, s)
+	}
+	return
+}
+
+// Migrate applies the registered migrations that were not applied yet, each
+// in its own transaction, and returns the status of all migrations. It stops
+// at the first migration that fails. That migration is rolled back and is
+// not recorded as applied.
+func (mgr *EntityManager) Migrate() (status []MigrationStatus, err error) {
+	if err = mgr.reconcileMigrationTable(); err != nil {
+		return
+	}
+	if status, err = mgr.MigrationStatus(); err != nil {
+		return
+	}
+	for ix := range status {
+		s := &status[ix]
+		if s.Applied {
+			continue
+		}
+		var at time.Time
+		if err = mgr.Transaction(func(tx *sql.Tx) (err error) {
+			at, err = mgr.applyMigration(tx, s.Migration)
+			return
+		}); err != nil {
+			err = errors.New(fmt.Sprintf("migration %s failed: %s", s.Migration, err))
+			return
+		}
+		s.Applied, s.AppliedAt = true, at
+	}
+	return
+}
+
+func (mgr *EntityManager) applyMigration(tx *sql.Tx, migration *Migration) (at time.Time, err error) {
+	if migration.Func != nil {
+		err = migration.Func(mgr, tx)
+	} else {
+		err = mgr.runSQLFile(tx, migration.SQLFile)
+	}
+	if err != nil {
+		return
+	}
+	row := tx.QueryRow(fmt.Sprintf("INSERT INTO %q.%q (\"scope\", \"version\", \"name\", \"applied\") VALUES ($1, $2, $3, now()) RETURNING \"applied\"",
+		mgr.Schema, MigrationTable), migration.Scope(), migration.Version, migration.Name)
+	err = row.Scan(&at)
+	return
+}
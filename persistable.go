@@ -6,7 +6,6 @@ import (
 	"fmt"
 	"net/url"
 	"reflect"
-	"strconv"
 	"strings"
 )
 
@@ -188,6 +187,12 @@ func Copy(src, target Persistable) (ret Persistable, err error) {
 	for _, index := range kind.Transient {
 		copyVal(index)
 	}
+	for _, link := range kind.Links {
+		copyVal(link.Index)
+	}
+	for _, coll := range kind.Children {
+		copyVal(coll.Index)
+	}
 	target.SetManager(src.Manager())
 	return target, nil
 }
@@ -197,7 +202,12 @@ func Populate(e Persistable, values map[string]interface{}) (ret Persistable, er
 	v := reflect.ValueOf(e).Elem()
 	for name, value := range values {
 		column, ok := k.Column(name)
+		link, isLink := k.Link(name)
 		switch {
+		case isLink:
+			if err = link.SetValue(e, value); err != nil {
+				return
+			}
 		case ok && value != nil:
 			if setter, ok := column.Converter.(Setter); ok {
 				err = setter.SetValue(e, column, value)
@@ -210,10 +220,10 @@ func Populate(e Persistable, values map[string]interface{}) (ret Persistable, er
 			}
 		case !ok:
 			field := v.FieldByName(name)
-			if field.IsValid() {
-				field.Set(reflect.ValueOf(value))
-			} else {
+			if !field.IsValid() {
 				e.SetSyntheticField(name, value)
+			} else if err = assign(field, value); err != nil {
+				return
 			}
 		}
 	}
@@ -300,9 +310,8 @@ func MakeEntityManager() (mgr *EntityManager, err error) {
 }
 
 func (mgr *EntityManager) Make(kind interface{}, parent *Key, id int) (entity Persistable, err error) {
-	k := GetKind(kind)
-	if k == nil {
-		err = errors.New(fmt.Sprintf("cannot determine kind of object %v", kind))
+	k, err := KindOf(kind)
+	if err != nil {
 		return
 	}
 	if parent == nil {
@@ -326,9 +335,8 @@ func (mgr *EntityManager) New(kind interface{}, parent *Key) (entity Persistable
 }
 
 func (mgr *EntityManager) Get(kind interface{}, id int) (ret Persistable, err error) {
-	k := GetKind(kind)
-	if k == nil {
-		err = errors.New(fmt.Sprintf("invalid entity kind %T", kind))
+	k, err := KindOf(kind)
+	if err != nil {
 		return
 	}
 	if id <= 0 {
@@ -363,6 +371,66 @@ func (mgr *EntityManager) Get(kind interface{}, id int) (ret Persistable, err er
 	return
 }
 
+// GetByKey returns the entity identified by key, or nil if it doesn't exist.
+func (mgr *EntityManager) GetByKey(key *Key) (ret Persistable, err error) {
+	if key == nil || key.IsZero() {
+		err = errors.New("cannot GetByKey() entity with zero key")
+		return
+	}
+	return mgr.Get(key.Kind(), key.Id())
+}
+
+// GetMulti returns the entities identified by keys, in the order of keys.
+// Entities that are not in the cache are read with one query per Kind. The
+// entries for missing entities and for nil or zero keys are nil.
+func (mgr *EntityManager) GetMulti(keys []*Key) (ret []Persistable, err error) {
+	ret = make([]Persistable, len(keys))
+	kinds := make([]*Kind, 0)
+	ids := make(map[*Kind][]int)
+	for _, key := range keys {
+		if key == nil || key.IsZero() || key.Id() <= 0 || mgr.cache.Has(key.Kind(), key.Id()) {
+			continue
+		}
+		if _, ok := ids[key.Kind()]; !ok {
+			kinds = append(kinds, key.Kind())
+		}
+		ids[key.Kind()] = append(ids[key.Kind()], key.Id())
+	}
+	found := make(map[*Kind]map[int]Persistable)
+	for _, k := range kinds {
+		query := mgr.MakeQuery(k)
+		query.AddCondition(&HasIds{Ids: ids[k]})
+		query.AddReferenceJoins()
+		var e Persistable
+		if e, err = mgr.Make(k, nil, 0); err != nil {
+			return
+		}
+		if qp, ok := e.(GetQueryProcessor); ok {
+			query = qp.GetQuery(query)
+		}
+		var results [][]Persistable
+		if results, err = query.Execute(); err != nil {
+			return
+		}
+		found[k] = make(map[int]Persistable)
+		for _, row := range results {
+			found[k][row[0].Id()] = row[0]
+			mgr.Stash(row[0])
+		}
+	}
+	for ix, key := range keys {
+		if key == nil || key.IsZero() {
+			continue
+		}
+		if e, ok := found[key.Kind()][key.Id()]; ok {
+			ret[ix] = e
+		} else if mgr.cache.Has(key.Kind(), key.Id()) {
+			ret[ix] = mgr.cache.Get(key.Kind(), key.Id())
+		}
+	}
+	return
+}
+
 func (mgr *EntityManager) Stash(e Persistable) {
 	mgr.cache.Put(e)
 }
@@ -372,7 +440,11 @@ func (mgr *EntityManager) Unstash(e Persistable) {
 }
 
 func (mgr *EntityManager) Query(kind interface{}, q url.Values) (ret [][]Persistable, err error) {
-	query := mgr.MakeQuery(kind)
+	k, err := KindOf(kind)
+	if err != nil {
+		return
+	}
+	query := mgr.MakeQuery(k)
 	e, err := mgr.Make(query.Kind, nil, 0)
 	if err != nil {
 		return
@@ -383,19 +455,37 @@ func (mgr *EntityManager) Query(kind interface{}, q url.Values) (ret [][]Persist
 	}
 	for _, col := range query.Kind.Columns {
 		if q.Get(col.FieldName) != "" {
-			refConv, ok := col.Converter.(*ReferenceConverter)
-			if ok {
-				var id int64
-				id, err = strconv.ParseInt(q.Get(col.FieldName), 0, 0)
-				if err != nil {
+			switch converter := col.Converter.(type) {
+			case *ReferenceConverter:
+				var id int
+				if id, err = ParseId(converter.References, q.Get(col.FieldName)); err != nil {
 					return
 				}
-				k, _ := CreateKey(nil, GetKind(refConv.References), int(id))
+				k, _ := CreateKey(nil, converter.References, id)
 				query.AddCondition(&References{
 					Column:     col.FieldName,
 					References: k,
 				})
-			} else {
+			case *PolymorphicReferenceConverter:
+				value := q.Get(col.FieldName)
+				if strings.HasPrefix(value, "(") {
+					var k *Key
+					if k, err = ParseKey(value); err != nil {
+						return
+					}
+					query.AddCondition(&References{Column: col.ColumnName, References: k})
+				} else if k, e := DecodeKey(value); e == nil && !k.IsZero() {
+					query.AddCondition(&References{Column: col.ColumnName, References: k})
+				} else {
+					query.AddCondition(&ReferencesKind{Column: col.ColumnName, Kinds: strings.Split(value, ",")})
+				}
+			case *ArrayConverter:
+				var cond Condition
+				if cond, err = MakeArrayCondition(q.Get("_array"), col.ColumnName, q.Get(col.FieldName)); err != nil {
+					return
+				}
+				query.AddCondition(cond)
+			default:
 				query.AddCondition(&Predicate{
 					Expression: fmt.Sprintf("__alias__.\"%s\"", col.ColumnName),
 					Operator:   op,
@@ -404,6 +494,34 @@ func (mgr *EntityManager) Query(kind interface{}, q url.Values) (ret [][]Persist
 			}
 		}
 	}
+	for _, link := range query.Kind.Links {
+		if q.Get(link.FieldName) == "" {
+			continue
+		}
+		refs := make([]*Key, 0)
+		for _, idStr := range strings.Split(q.Get(link.FieldName), ",") {
+			var id int
+			if id, err = ParseId(link.References, idStr); err != nil {
+				return
+			}
+			k, _ := CreateKey(nil, link.References, id)
+			refs = append(refs, k)
+		}
+		query.AddCondition(&HasAnyOf{Field: link.FieldName, References: refs})
+	}
+	for _, name := range []string{"_null", "_notnull"} {
+		if q.Get(name) == "" {
+			continue
+		}
+		for _, field := range strings.Split(q.Get(name), ",") {
+			col, ok := query.Kind.ColumnByFieldName(field)
+			if !ok {
+				err = errors.New(fmt.Sprintf("kind '%s' has no field %q", query.Kind.Kind, field))
+				return
+			}
+			query.AddCondition(&IsNull{Column: col.ColumnName, Invert: name == "_notnull"})
+		}
+	}
 	if q.Get("_parent") != "" {
 		var parent *Key
 		parent, err = ParseKey(q.Get("_parent"))
@@ -412,6 +530,13 @@ func (mgr *EntityManager) Query(kind interface{}, q url.Values) (ret [][]Persist
 		}
 		query.AddCondition(&HasParent{Parent: parent})
 	}
+	if q.Get("_q") != "" {
+		if !query.Kind.Searchable() {
+			err = errors.New(fmt.Sprintf("kind '%s' has no searchable fields", query.Kind.Kind))
+			return
+		}
+		query.Search(q.Get("_q"))
+	}
 	if q.Get("_sort") != "" {
 		for _, sortorder := range strings.Split(q.Get("_sort"), ";") {
 			s := strings.Split(sortorder, ":")
@@ -428,11 +553,11 @@ func (mgr *EntityManager) Query(kind interface{}, q url.Values) (ret [][]Persist
 		query.AddParentJoin(pkind)
 		if q.Get(pkind) != "" {
 			var parent Persistable
-			var id64 int64
-			if id64, err = strconv.ParseInt(q.Get(pkind), 0, 0); err != nil {
+			var id int
+			if id, err = ParseId(GetKind(pkind), q.Get(pkind)); err != nil {
 				return
 			}
-			if parent, err = mgr.Get(pkind, int(id64)); err != nil {
+			if parent, err = mgr.Get(pkind, id); err != nil {
 				return
 			}
 			query.AddCondition(&HasParent{Parent: parent.AsKey()})
@@ -514,9 +639,9 @@ func update(e Persistable, conn *sql.DB) (err error) {
 }
 
 var insertEntity = SQLTemplate{Name: "InsertNewEntity", SQL: `INSERT INTO {{.QualifiedTableName}}
-	( "_parent"{{range $i, $c := .Columns}}{{if not .Formula}}, "{{$c.ColumnName}}"{{end}}{{end}} )
+	( "_parent"{{if .SingleTable}}, "_kind"{{end}}{{range $i, $c := .Columns}}{{if not .Formula}}, "{{$c.ColumnName}}"{{end}}{{end}} )
 	VALUES
-	( __count__{{range .Columns}}{{if not .Formula}}, {{.Converter.SQLTextOut .}}{{end}}{{end}} )
+	( __count__{{if .SingleTable}}, __count__{{end}}{{range .Columns}}{{if not .Formula}}, {{.Converter.SQLTextOut .}}{{end}}{{end}} )
 	RETURNING "_id"
 `}
 
@@ -529,6 +654,9 @@ func insert(e Persistable, conn *sql.DB) (err error) {
 	}
 	values := make([]interface{}, 0)
 	values = append(values, e.AsKey().Parent().Chain())
+	if k.SingleTable {
+		values = append(values, k.Kind)
+	}
 	for _, column := range k.Columns {
 		if column.Formula == "" {
 			columnValues, err := column.Converter.Value(e, column)
@@ -553,6 +681,45 @@ func insert(e Persistable, conn *sql.DB) (err error) {
 	return
 }
 
+var upsertEntity = SQLTemplate{Name: "UpsertEntity", SQL: `INSERT INTO {{.QualifiedTableName}} AS t
+	( "_parent"{{if .SingleTable}}, "_kind"{{end}}{{range $i, $c := .Columns}}{{if not .Formula}}, "{{$c.ColumnName}}"{{end}}{{end}} )
+	VALUES
+	( __count__{{if .SingleTable}}, __count__{{end}}{{range .Columns}}{{if not .Formula}}, {{.Converter.SQLTextOut .}}{{end}}{{end}} )
+	ON CONFLICT ( {{range $i, $c := .NaturalKeyIndexColumns}}{{if gt $i 0}}, {{end}}"{{$c}}"{{end}} )
+	DO UPDATE SET "_id" = t."_id"{{range .Columns}}{{if not .Formula}}, "{{.ColumnName}}" = EXCLUDED."{{.ColumnName}}"{{end}}{{end}}
+	RETURNING "_id"
+`}
+
+func upsert(e Persistable, conn *sql.DB) (err error) {
+	k := e.Kind()
+	var sqlText string
+	sqlText, err = upsertEntity.Process(k)
+	if err != nil {
+		return
+	}
+	values := make([]interface{}, 0)
+	values = append(values, e.AsKey().Parent().Chain())
+	if k.SingleTable {
+		values = append(values, k.Kind)
+	}
+	for _, column := range k.Columns {
+		if column.Formula == "" {
+			columnValues, err := column.Converter.Value(e, column)
+			if err != nil {
+				return err
+			}
+			values = append(values, columnValues...)
+		}
+	}
+	var id int
+	if err = conn.QueryRow(sqlText, values...).Scan(&id); err != nil {
+		return
+	}
+	e.Initialize(nil, id)
+	e.SetPopulated()
+	return
+}
+
 var deleteEntity = SQLTemplate{Name: "DeleteEntity", SQL: `DELETE FROM {{.QualifiedTableName}} WHERE _id = $1`}
 
 func del(e Persistable, conn *sql.DB) (err error) {
@@ -570,9 +737,17 @@ func del(e Persistable, conn *sql.DB) (err error) {
 	return
 }
 
+// Adopt makes e the parent of children and puts them. Children that were
+// stored before are moved first, with their descendants, using Move.
 func (mgr *EntityManager) Adopt(e Persistable, children []Persistable) (err error) {
 	for _, child := range children {
-		child.Initialize(e, child.Id())
+		if child.Id() > 0 {
+			if err = mgr.Move(child, e); err != nil {
+				return
+			}
+		} else {
+			child.Initialize(e, child.Id())
+		}
 		if err = child.Manager().Put(child); err != nil {
 			return
 		}
@@ -581,7 +756,10 @@ func (mgr *EntityManager) Adopt(e Persistable, children []Persistable) (err erro
 }
 
 func (mgr *EntityManager) Put(e Persistable) (err error) {
-	SetKind(e)
+	if SetKind(e) == nil {
+		_, err = KindOf(e)
+		return
+	}
 	return mgr.TX(func(db *sql.DB) (err error) {
 		putInterceptor, ok := e.(PutInterceptor)
 		if ok {
@@ -589,6 +767,9 @@ func (mgr *EntityManager) Put(e Persistable) (err error) {
 				return
 			}
 		}
+		if err = Validate(e); err != nil {
+			return
+		}
 		if e.Id() > 0 {
 			if err = update(e, db); err != nil {
 				return
@@ -610,6 +791,52 @@ func (mgr *EntityManager) Put(e Persistable) (err error) {
 			}
 			mgr.Stash(e)
 		}
+		if err = mgr.syncLinks(e, db); err != nil {
+			return
+		}
+		if ok {
+			if err = putInterceptor.AfterPut(); err != nil {
+				return
+			}
+		}
+		return
+	})
+}
+
+// Upsert stores e like Put does, except that a new entity whose natural key
+// is already taken updates the existing entity instead. This happens in a
+// single statement, so concurrent upserts of the same key can't conflict.
+// Since it is not known beforehand whether a row is inserted, the
+// InsertInterceptor methods are not called.
+func (mgr *EntityManager) Upsert(e Persistable) (err error) {
+	if SetKind(e) == nil {
+		_, err = KindOf(e)
+		return
+	}
+	if e.Id() > 0 {
+		return mgr.Put(e)
+	}
+	if len(e.Kind().NaturalKey) == 0 {
+		err = errors.New(fmt.Sprintf("cannot upsert entity of kind '%s' without natural key", e.Kind().Kind))
+		return
+	}
+	return mgr.TX(func(db *sql.DB) (err error) {
+		putInterceptor, ok := e.(PutInterceptor)
+		if ok {
+			if err = putInterceptor.OnPut(); err != nil {
+				return
+			}
+		}
+		if err = Validate(e); err != nil {
+			return
+		}
+		if err = upsert(e, db); err != nil {
+			return
+		}
+		mgr.Stash(e)
+		if err = mgr.syncLinks(e, db); err != nil {
+			return
+		}
 		if ok {
 			if err = putInterceptor.AfterPut(); err != nil {
 				return
@@ -628,6 +855,9 @@ func (mgr *EntityManager) Delete(e Persistable) (err error) {
 					return
 				}
 			}
+			if err = mgr.deleteLinks(e, db); err != nil {
+				return
+			}
 			if err = del(e, db); err == nil {
 				mgr.Unstash(e)
 			}
@@ -638,7 +868,7 @@ func (mgr *EntityManager) Delete(e Persistable) (err error) {
 
 func (mgr *EntityManager) MakeQuery(kind interface{}) *Query {
 	k := GetKind(kind)
-	if kind == nil {
+	if k == nil {
 		panic(fmt.Sprintf("Cannot create query for '%v'", kind))
 	}
 	query := new(Query)
@@ -669,6 +899,39 @@ func (mgr *EntityManager) ByColumnAndParent(kind interface{}, parent *Key, colum
 	return mgr.ByColumnsAndParent(kind, parent, cols)
 }
 
+// GetByNaturalKey returns the entity of the given kind with the given natural
+// key values, in key order, or nil if there is none. For scoped keys parent
+// is the parent of the entity, with nil meaning a root entity.
+func (mgr *EntityManager) GetByNaturalKey(kind interface{}, parent *Key, values ...interface{}) (entity Persistable, err error) {
+	k, err := KindOf(kind)
+	if err != nil {
+		return
+	}
+	columns, err := k.NaturalKeyColumns()
+	if err != nil {
+		return
+	}
+	if len(columns) == 0 {
+		err = errors.New(fmt.Sprintf("kind '%s' has no natural key", k.Kind))
+		return
+	}
+	if len(values) != len(columns) {
+		err = errors.New(fmt.Sprintf("natural key of kind '%s' has %d fields, got %d values",
+			k.Kind, len(columns), len(values)))
+		return
+	}
+	cols := make(map[string]interface{}, len(columns))
+	for ix, column := range columns {
+		cols[column.FieldName] = values[ix]
+	}
+	if !k.ScopedKey {
+		parent = nil
+	} else if parent == nil {
+		parent = ZeroKey
+	}
+	return mgr.ByColumnsAndParent(k, parent, cols)
+}
+
 func (mgr *EntityManager) FindOrCreate(kind interface{}, parent *Key, field string, value string) (e Persistable, err error) {
 	cols := make(map[string]interface{}, 1)
 	cols[field] = value
@@ -39,6 +39,7 @@ type Computed struct {
 	Alias   string
 	Name    string
 	Query   *Query
+	Params  []interface{} // Values of the __count__ placeholders in Formula
 }
 
 func (computed Computed) SQLFormula() string {
@@ -84,6 +85,15 @@ func (table *QueryTable) AddAggregate(agg Aggregate) *QueryTable {
 	return table
 }
 
+// values appends the parameters of the computed columns and the conditions
+// of the table to values, in the order they appear in the query text.
+func (table *QueryTable) values(values []interface{}) []interface{} {
+	for _, computed := range table.Computed {
+		values = append(values, computed.Params...)
+	}
+	return table.Conditions.Values(values)
+}
+
 func (table *QueryTable) AddComputedColumn(computed Computed) *QueryTable {
 	computed.Query = table.Query
 	if table.Computed == nil {
@@ -103,10 +113,18 @@ func (table *QueryTable) IsAggregated() bool {
 }
 
 func (table *QueryTable) AddFilter(field string, value interface{}) *QueryTable {
+	if _, ok := table.Kind.Link(field); ok {
+		table.AddCondition(&HasAnyOf{Kind: table.Kind, Field: field, References: value})
+		return table
+	}
 	column, ok := table.Kind.ColumnByFieldName(field)
 	if !ok {
 		return table
 	}
+	if value == nil {
+		table.AddCondition(&IsNull{Column: column.ColumnName})
+		return table
+	}
 	table.AddCondition(&Predicate{
 		Expression: fmt.Sprintf("__alias__.\"%s\"", column.ColumnName),
 		Operator:   "=",
@@ -127,11 +145,36 @@ func (table *QueryTable) HasParent(parent Persistable) *QueryTable {
 }
 
 func (table *QueryTable) WhereClause(queryConstraint bool) string {
+	clauses := make([]string, 0, 2)
+	if table.Kind.SingleTable {
+		clauses = append(clauses, table.kindClause())
+	}
 	if table.Conditions.Size() > 0 {
-		return "WHERE " + table.Conditions.WhereClause(table.Query, queryConstraint)
-	} else {
+		clauses = append(clauses, table.Conditions.WhereClause(table.Query, queryConstraint))
+	}
+	if len(clauses) == 0 {
 		return ""
 	}
+	return "WHERE " + strings.Join(clauses, " AND ")
+}
+
+// kindClause selects the rows of the Kind of the table, and, if WithDerived
+// is set, of the Kinds derived from it, from a table shared by a single-table
+// hierarchy.
+func (table *QueryTable) kindClause() string {
+	kinds := []string{fmt.Sprintf("'%s'", table.Kind.Kind)}
+	if table.WithDerived {
+		for _, derived := range table.Kind.DerivedKinds() {
+			kinds = append(kinds, fmt.Sprintf("'%s'", derived.Kind))
+		}
+	}
+	return fmt.Sprintf("(\"_kind\" IN ( %s ))", strings.Join(kinds, ", "))
+}
+
+// UnionDerived returns whether the rows of the Kinds derived from the Kind of
+// the table are read with a UNION ALL over their tables.
+func (table *QueryTable) UnionDerived() bool {
+	return table.WithDerived && !table.Kind.SingleTable
 }
 
 func (table *QueryTable) OffsetAndLimit() (ret string) {
@@ -275,13 +318,19 @@ type Sort struct {
 }
 
 func (sort *Sort) SQLText() string {
+	column := sort.Column
+	if sort.Alias == "" || sort.Alias == sort.Query.Alias {
+		if col, ok := sort.Query.Kind.ColumnByFieldName(sort.Column); ok {
+			column = col.ColumnName
+		}
+	}
 	if sort.Alias == "" {
 		sort.Alias = sort.Query.Alias
 	}
 	if sort.Direction == "" {
 		sort.Direction = Ascending
 	}
-	return fmt.Sprintf("%s.%q %s", sort.Alias, sort.Column, sort.Direction)
+	return fmt.Sprintf("%s.%q %s", sort.Alias, column, sort.Direction)
 }
 
 // --------------------------------------------------------------------------
@@ -294,6 +343,9 @@ type Query struct {
 	GlobalComputed  []Computed
 	QueryConditions CompoundCondition
 	Sorting         []Sort
+	shallow         bool
+	preload         []string
+	preloadAll      bool
 }
 
 func (query *Query) AddQueryCondition(cond Condition) *Query {
@@ -301,6 +353,16 @@ func (query *Query) AddQueryCondition(cond Condition) *Query {
 	return query
 }
 
+// Preload makes Execute fill the child collections with the given field
+// names, or all of them if no names are given, of the entities returned.
+func (query *Query) Preload(fields ...string) *Query {
+	if len(fields) == 0 {
+		query.preloadAll = true
+	}
+	query.preload = append(query.preload, fields...)
+	return query
+}
+
 func (query *Query) AddJoin(join Join) *Query {
 	if query.Joins == nil {
 		query.Joins = make([]Join, 0)
@@ -476,12 +538,12 @@ func (query *Query) SelectWhereClause(queryConstraint bool) string {
 var querySQL = SQLTemplate{Name: "Query", SQL: `
 {{define "WithTable"}}{{$Current := .}}
 	{{.Alias}} AS (
-		SELECT '{{.Kind.Kind}}' "_kind", "_parent", "_id"
+		SELECT {{if .Kind.SingleTable}}"_kind"{{else}}'{{.Kind.Kind}}' "_kind"{{end}}, "_parent", "_id"
 				{{range .Kind.Columns}}, {{.Formula}} {{.Converter.SQLTextIn . "" true}}{{end}} 
 				{{range .Computed}}, {{.SQLFormula}}{{end}} 
 			FROM {{.Kind.QualifiedTableName}}
 		    {{.WhereClause false}}
-		{{if .WithDerived}}{{range .Kind.DerivedKinds}}
+		{{if .UnionDerived}}{{range .Kind.DerivedKinds}}
 		UNION ALL
 		SELECT '{{.Kind}}' "_kind", "_parent", "_id"
  				{{range $Current.Kind.Columns}}, {{.Formula}} {{.Converter.SQLTextIn . "" true}}{{end}} 
@@ -550,55 +612,91 @@ func (query *Query) SQLText() (s string) {
 func (query *Query) SQL() (s string, values []interface{}) {
 	s = query.SQLText()
 	values = make([]interface{}, 0)
-	values = query.Conditions.Values(values)
-	if query.WithDerived {
+	values = query.QueryTable.values(values)
+	if query.UnionDerived() {
 		for _, _ = range query.Kind.DerivedKinds() {
-			values = query.Conditions.Values(values)
+			values = query.QueryTable.values(values)
 		}
 	}
 	for _, join := range query.Joins {
-		values = join.Conditions.Values(values)
-		if join.WithDerived {
+		values = join.QueryTable.values(values)
+		if join.UnionDerived() {
 			for _, _ = range join.Kind.DerivedKinds() {
-				values = join.Conditions.Values(values)
+				values = join.QueryTable.values(values)
 			}
 		}
 	}
 	for _, sq := range query.SubQueries {
-		values = sq.Conditions.Values(values)
+		values = sq.QueryTable.values(values)
+	}
+	for _, computed := range query.GlobalComputed {
+		values = append(values, computed.Params...)
 	}
 	values = query.QueryConditions.Values(values)
 	return
 }
 
-func (query *Query) Execute() (ret [][]Persistable, err error) {
-	err = query.Manager.TX(func(conn *sql.DB) (err error) {
-		sqlText, values := query.SQL()
-		rows, err := conn.Query(sqlText, values...)
-		if err != nil {
-			return
-		}
-		ret = make([][]Persistable, 0)
-		scanners, err := MakeScanners(query)
-		if err != nil {
-			return
+func (query *Query) ForEach(fnc func(row []Persistable) error) (err error) {
+	return query.Manager.TX(func(conn *sql.DB) error {
+		return query.forEach(conn, fnc)
+	})
+}
+
+func (query *Query) forEach(conn sqlExecutor, fnc func(row []Persistable) error) (err error) {
+	sqlText, values := query.SQL()
+	rows, err := conn.Query(sqlText, values...)
+	if err != nil {
+		return
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+	scanners, err := MakeScanners(query)
+	if err != nil {
+		return
+	}
+	s, err := scanners.SQLScanners()
+	if err != nil {
+		return
+	}
+	for rows.Next() {
+		if err = rows.Scan(s...); err != nil {
+			return err
 		}
-		s, err := scanners.SQLScanners()
+		result, err := scanners.Build()
 		if err != nil {
-			return
+			return err
 		}
-		for rows.Next() {
-			if err = rows.Scan(s...); err != nil {
-				return err
-			}
-			result, err := scanners.Build()
-			if err != nil {
-				return err
-			}
-			ret = append(ret, result)
+		if err = fnc(result); err != nil {
+			return err
 		}
-		return
+	}
+	return rows.Err()
+}
+
+// Execute runs the query and returns all rows. Unlike ForEach, it also
+// loads the many-to-many relations of the returned entities, and the child
+// collections requested with Preload.
+func (query *Query) Execute() (ret [][]Persistable, err error) {
+	ret = make([][]Persistable, 0)
+	err = query.ForEach(func(row []Persistable) error {
+		ret = append(ret, row)
+		return nil
 	})
+	if err == nil && !query.shallow {
+		err = query.Manager.loadLinks(ret)
+	}
+	if err == nil && (query.preloadAll || len(query.preload) > 0) {
+		parents := make([]Persistable, 0, len(ret))
+		for _, row := range ret {
+			parents = append(parents, row[0])
+		}
+		fields := query.preload
+		if query.preloadAll {
+			fields = nil
+		}
+		err = query.Manager.PreloadChildren(parents, fields...)
+	}
 	return
 }
 
@@ -0,0 +1,117 @@
+package grumble
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// -- F U L L - T E X T  S E A R C H ----------------------------------------
+
+// RankField is the name of the synthetic field holding the ts_rank of the
+// entities returned by a Search.
+const RankField = "_rank"
+
+// DefaultSearchConfig is the text search configuration used for Kinds that
+// don't have a searchconfig tag.
+const DefaultSearchConfig = "english"
+
+var searchWeights = map[string]bool{"A": true, "B": true, "C": true, "D": true}
+
+func (k *Kind) searchConfig() string {
+	if k.SearchConfig == "" {
+		return DefaultSearchConfig
+	}
+	return k.SearchConfig
+}
+
+// searchColumns returns the columns stored in the table of k that have a
+// searchable tag. For single-table hierarchies these are the searchable
+// columns of all Kinds in the hierarchy.
+func (k *Kind) searchColumns() (columns []Column) {
+	all := k.Columns
+	if k.SingleTable {
+		root := k
+		for root.BaseKind != nil {
+			root = root.BaseKind
+		}
+		all, _ = root.singleTableColumns()
+	}
+	for _, column := range all {
+		if column.SearchWeight != "" && column.Formula == "" {
+			columns = append(columns, column)
+		}
+	}
+	return
+}
+
+// Searchable returns whether the Kind has fields with a searchable tag.
+func (k *Kind) Searchable() bool {
+	return len(k.searchColumns()) > 0
+}
+
+// searchColumn returns the generated tsvector column combining the columns
+// with a searchable tag, weighted by the value of the tag.
+func (k *Kind) searchColumn(columns []Column) (column SQLColumn, ok bool) {
+	config := pq.QuoteLiteral(k.searchConfig())
+	vectors := make([]string, 0)
+	for _, col := range columns {
+		if col.SearchWeight == "" || col.Formula != "" {
+			continue
+		}
+		vectors = append(vectors, fmt.Sprintf("setweight(to_tsvector(%s::regconfig, coalesce(%q, '')), '%s')",
+			config, col.ColumnName, col.SearchWeight))
+	}
+	if len(vectors) == 0 {
+		return
+	}
+	column = _searchColumn
+	column.Generated = strings.Join(vectors, " || ")
+	return column, true
+}
+
+// Search matches the entities of Kind whose searchable fields match Text.
+// Text uses web search syntax: words, "quoted phrases", OR, and -excluded
+// words. It can only be used as a table condition.
+type Search struct {
+	Kind *Kind
+	Text string
+}
+
+func (cond *Search) WhereClause(query *Query, queryConstraint bool) string {
+	alias := ""
+	if queryConstraint {
+		alias = query.Alias + "."
+	}
+	return fmt.Sprintf("%s\"_search\" @@ websearch_to_tsquery(%s::regconfig, __count__)",
+		alias, pq.QuoteLiteral(cond.Kind.searchConfig()))
+}
+
+func (cond *Search) Values(values []interface{}) []interface{} {
+	return append(values, cond.Text)
+}
+
+// Search restricts the table to the entities matching text, and adds their
+// ts_rank as the synthetic field _rank.
+func (table *QueryTable) Search(text string) *QueryTable {
+	if !table.Kind.Searchable() {
+		panic(fmt.Sprintf("Kind '%s' has no searchable fields", table.Kind.Kind))
+	}
+	table.AddCondition(&Search{Kind: table.Kind, Text: text})
+	table.AddComputedColumn(Computed{
+		Formula: fmt.Sprintf("ts_rank(\"_search\", websearch_to_tsquery(%s::regconfig, __count__))",
+			pq.QuoteLiteral(table.Kind.searchConfig())),
+		Name:   RankField,
+		Params: []interface{}{text},
+	})
+	return table
+}
+
+// Search restricts the query to the entities matching text, and orders them
+// by rank, best match first.
+func (query *Query) Search(text string) *Query {
+	query.QueryTable.Search(text)
+	query.AddSort(Sort{Column: RankField, Direction: Descending})
+	return query
+}
@@ -2,6 +2,7 @@ package grumble
 
 import (
 	"fmt"
+	"regexp"
 	"strconv"
 	"strings"
 )
@@ -110,6 +111,27 @@ func (tags *Tags) GetStringList(name string) (ret []string) {
 	return
 }
 
+// GetRegexp returns the value of the tag name compiled as a regular
+// expression that must match the whole string.
+func (tags *Tags) GetRegexp(name string) (ret *regexp.Regexp, ok bool) {
+	val, ok := tags.tags[name]
+	if ok {
+		ret, ok = val.(*regexp.Regexp)
+		return
+	}
+	s, ok := tags.stringTags[name]
+	if !ok {
+		return
+	}
+	var err error
+	if ret, err = regexp.Compile("^(?:" + s + ")$"); err != nil {
+		ok = false
+		return
+	}
+	tags.Set(name, ret)
+	return
+}
+
 func (tags *Tags) Put(name string, value string) {
 	delete(tags.tags, name)
 	tags.stringTags[name] = value
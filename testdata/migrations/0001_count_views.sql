@@ -0,0 +1 @@
+UPDATE "{{.Schema}}"."posting" SET "Views" = "Views" + 1;
@@ -91,13 +91,11 @@ func resetSchema(w http.ResponseWriter, mgr *grumble.EntityManager) {
 		return
 	}
 	err = mgr.TX(func(db *sql.DB) error {
-		for _, k := range grumble.Kinds() {
-			if e := k.Reconcile(mgr.PostgreSQLAdapter); e != nil {
-				return e
-			}
-		}
-		return nil
+		return grumble.ReconcileAll(mgr.PostgreSQLAdapter)
 	})
+	if err == nil {
+		_, err = mgr.Migrate()
+	}
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
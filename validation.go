@@ -0,0 +1,160 @@
+package grumble
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// ValidationErrors holds the messages of a failed validation, keyed by field
+// name. Messages that do not belong to a single field are stored under the
+// empty key.
+type ValidationErrors map[string][]string
+
+func (errs ValidationErrors) Add(field string, message string) {
+	errs[field] = append(errs[field], message)
+}
+
+func (errs ValidationErrors) Merge(other ValidationErrors) {
+	for field, messages := range other {
+		errs[field] = append(errs[field], messages...)
+	}
+}
+
+func (errs ValidationErrors) Error() string {
+	fields := make([]string, 0, len(errs))
+	for field := range errs {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	msgs := make([]string, 0)
+	for _, field := range fields {
+		for _, msg := range errs[field] {
+			if field == "" {
+				msgs = append(msgs, msg)
+			} else {
+				msgs = append(msgs, fmt.Sprintf("%s %s", field, msg))
+			}
+		}
+	}
+	return "validation failed: " + strings.Join(msgs, "; ")
+}
+
+// Validator can be implemented by entities that need checks beyond the ones
+// expressed in their tags. Returning ValidationErrors reports errors for
+// individual fields, any other error is reported for the entity as a whole.
+type Validator interface {
+	Validate() error
+}
+
+// Validate checks the column values of e against the validation tags of
+// its Kind, and calls e's Validate method if it implements Validator.
+//
+// The supported tags are required, min, max, minlen, maxlen, pattern and
+// oneof. Empty strings and slices are only checked by required.
+func Validate(e Persistable) (err error) {
+	k := e.Kind()
+	if k == nil {
+		return
+	}
+	errs := ValidationErrors{}
+	v := reflect.ValueOf(e).Elem()
+	for _, column := range k.Columns {
+		if column.Formula != "" {
+			continue
+		}
+		column.validate(v.FieldByIndex(column.Index), errs)
+	}
+	if validator, ok := e.(Validator); ok {
+		if verr := validator.Validate(); verr != nil {
+			if fieldErrs, ok := verr.(ValidationErrors); ok {
+				errs.Merge(fieldErrs)
+			} else {
+				errs.Add("", verr.Error())
+			}
+		}
+	}
+	if len(errs) > 0 {
+		err = errs
+	}
+	return
+}
+
+func (column Column) validate(fld reflect.Value, errs ValidationErrors) {
+	tags := column.Tags
+	if tags == nil {
+		return
+	}
+	if column.Required && fld.IsZero() {
+		errs.Add(column.FieldName, "is required")
+		return
+	}
+	for fld.Kind() == reflect.Ptr {
+		if fld.IsNil() {
+			return
+		}
+		fld = fld.Elem()
+	}
+	if tags.Has("min") || tags.Has("max") {
+		if d, ok := decimalValue(fld); ok {
+			if min, err := ParseDecimal(tags.Get("min")); err == nil && d.Cmp(min) < 0 {
+				errs.Add(column.FieldName, fmt.Sprintf("must be at least %s", tags.Get("min")))
+			}
+			if max, err := ParseDecimal(tags.Get("max")); err == nil && d.Cmp(max) > 0 {
+				errs.Add(column.FieldName, fmt.Sprintf("must be at most %s", tags.Get("max")))
+			}
+		}
+	}
+	var length int
+	switch fld.Kind() {
+	case reflect.String:
+		length = utf8.RuneCountInString(fld.String())
+	case reflect.Slice, reflect.Map, reflect.Array:
+		length = fld.Len()
+	default:
+		length = -1
+	}
+	if length == 0 {
+		return
+	}
+	if minLen, ok := tags.GetInt("minlen"); ok && length >= 0 && length < minLen {
+		errs.Add(column.FieldName, fmt.Sprintf("must be at least %d characters long", minLen))
+	}
+	if maxLen, ok := tags.GetInt("maxlen"); ok && length > maxLen {
+		errs.Add(column.FieldName, fmt.Sprintf("must be at most %d characters long", maxLen))
+	}
+	if re, ok := tags.GetRegexp("pattern"); ok && fld.Kind() == reflect.String && !re.MatchString(fld.String()) {
+		errs.Add(column.FieldName, "has an invalid format")
+	}
+	if tags.Has("oneof") {
+		options := tags.GetStringList("oneof")
+		value := fmt.Sprintf("%v", fld.Interface())
+		found := false
+		for _, option := range options {
+			if strings.TrimSpace(option) == value {
+				found = true
+				break
+			}
+		}
+		if !found {
+			errs.Add(column.FieldName, fmt.Sprintf("must be one of %s", strings.Join(options, ", ")))
+		}
+	}
+}
+
+func decimalValue(fld reflect.Value) (d Decimal, ok bool) {
+	switch fld.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return NewDecimal(fld.Int(), 0), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		d, err := ParseDecimal(strconv.FormatUint(fld.Uint(), 10))
+		return d, err == nil
+	case reflect.Float32, reflect.Float64:
+		return DecimalFromFloat(fld.Float()), true
+	}
+	d, ok = fld.Interface().(Decimal)
+	return
+}